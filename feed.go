@@ -0,0 +1,260 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrSubscriberLagged means the subscription was closed as the subscriber
+// could not keep up with the change batches
+var ErrSubscriberLagged = fmt.Errorf("Subscriber lagged behind the change feed")
+
+// FeedPolicy specifies how the change feed handles a slow subscriber
+type FeedPolicy int
+
+const (
+	// FeedBlock blocks NewSnapshot until the subscriber accepts the batch
+	FeedBlock FeedPolicy = iota
+	// FeedDrop closes the subscription if its channel buffer is full
+	FeedDrop
+)
+
+const (
+	feedInsert byte = iota
+	feedDelete
+	// Delete of an item inserted in the same snapshot
+	feedCancel
+)
+
+type feedEvent struct {
+	typ byte
+	bs  []byte
+}
+
+// ChangeBatch describes the items changed by the writes committed in a
+// snapshot. The deleted items should be applied before the inserted items
+// as an item can be replaced in a snapshot.
+// A batch is shared by all the subscribers and it should not be modified.
+// Sn wraps around to 1 on reaching the 32 bit limit and SnGen is incremented.
+type ChangeBatch struct {
+	Sn       uint32
+	SnGen    uint32
+	Inserted [][]byte
+	Deleted  [][]byte
+}
+
+// Subscription delivers the change batches committed by NewSnapshot
+type Subscription struct {
+	m       *Nitro
+	ch      chan *ChangeBatch
+	done    chan struct{}
+	policy  FeedPolicy
+	startSn uint32
+	// The snapshot numbers wrap around. Hence, they are compared with
+	// startSn only until the first batch is delivered.
+	started bool
+	closed  bool
+	err     error
+	once    sync.Once
+
+	// sendLock is held while a batch is sent so that the channel is not
+	// closed during the send. A pending send is unblocked by closing done.
+	sendLock sync.Mutex
+}
+
+// The emitLock protects the subscriber list and the subscription state. It
+// is not held while sending the batches so that a subscriber can use the
+// subscription while NewSnapshot is blocked on it.
+type feedState struct {
+	subscribers int32
+	emitLock    sync.Mutex
+	subs        []*Subscription
+}
+
+// Subscribe creates a change feed subscription. The batches are delivered for
+// the snapshots created after the snapshot numbered StartSn(). Hence, the
+// snapshot with sn StartSn() is the base for the changes.
+func (m *Nitro) Subscribe(bufSize int, policy FeedPolicy) *Subscription {
+	s := &Subscription{
+		m:      m,
+		ch:     make(chan *ChangeBatch, bufSize),
+		done:   make(chan struct{}),
+		policy: policy,
+	}
+
+	m.feed.emitLock.Lock()
+	defer m.feed.emitLock.Unlock()
+
+	// The writers record the changes once they see a subscriber. The writes
+	// in the current snapshot may not have been recorded. A writer which
+	// enters the next snapshot sees the subscriber as it is counted before
+	// reading the current sn.
+	atomic.AddInt32(&m.feed.subscribers, 1)
+	s.startSn = m.getCurrSn()
+	m.feed.subs = append(m.feed.subs, s)
+	return s
+}
+
+// Changes returns the channel of change batches. The channel is closed once
+// the subscription is closed.
+func (s *Subscription) Changes() <-chan *ChangeBatch {
+	return s.ch
+}
+
+// StartSn returns the snapshot number after which the changes are delivered
+func (s *Subscription) StartSn() uint32 {
+	s.m.feed.emitLock.Lock()
+	defer s.m.feed.emitLock.Unlock()
+	return s.startSn
+}
+
+// Err returns ErrSubscriberLagged if the subscription was closed due to a
+// slow subscriber
+func (s *Subscription) Err() error {
+	s.m.feed.emitLock.Lock()
+	defer s.m.feed.emitLock.Unlock()
+	return s.err
+}
+
+// Close cancels the subscription
+func (s *Subscription) Close() {
+	s.m.closeSubscriber(s, nil)
+}
+
+// closeSubscriber unblocks a pending send before closing the subscription
+func (m *Nitro) closeSubscriber(s *Subscription, err error) {
+	s.once.Do(func() { close(s.done) })
+
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+
+	m.feed.emitLock.Lock()
+	defer m.feed.emitLock.Unlock()
+	if !s.closed && err != nil {
+		s.err = err
+	}
+	m.removeSubscriber(s)
+}
+
+// Caller should hold the send lock of the subscription and the emit lock
+func (m *Nitro) removeSubscriber(s *Subscription) {
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+	close(s.ch)
+	for i, x := range m.feed.subs {
+		if x == s {
+			m.feed.subs = append(m.feed.subs[:i], m.feed.subs[i+1:]...)
+			break
+		}
+	}
+	atomic.AddInt32(&m.feed.subscribers, -1)
+}
+
+func (w *Writer) recordChange(typ byte, bs []byte) {
+	if atomic.LoadInt32(&w.feed.subscribers) > 0 {
+		w.ep.feedEvents = append(w.ep.feedEvents, feedEvent{
+			typ: typ,
+			bs:  append([]byte(nil), bs...),
+		})
+	}
+}
+
+// emitChanges delivers the changes recorded by the writers for the snapshot
+// to the subscribers. It is called by NewSnapshot.
+func (m *Nitro) emitChanges(snap *Snapshot, events [][]feedEvent) {
+	if atomic.LoadInt32(&m.feed.subscribers) == 0 {
+		return
+	}
+
+	batch := &ChangeBatch{Sn: snap.sn, SnGen: snap.snGen}
+	inserts := make(map[string]int)
+	var order [][]byte
+	for _, evs := range events {
+		for _, ev := range evs {
+			switch ev.typ {
+			case feedInsert:
+				if _, ok := inserts[string(ev.bs)]; !ok {
+					order = append(order, ev.bs)
+				}
+				inserts[string(ev.bs)]++
+			case feedCancel:
+				inserts[string(ev.bs)]--
+			case feedDelete:
+				batch.Deleted = append(batch.Deleted, ev.bs)
+			}
+		}
+	}
+
+	for _, bs := range order {
+		if inserts[string(bs)] > 0 {
+			batch.Inserted = append(batch.Inserted, bs)
+		}
+	}
+
+	m.feed.emitLock.Lock()
+	subs := append([]*Subscription(nil), m.feed.subs...)
+	m.feed.emitLock.Unlock()
+
+	for _, s := range subs {
+		if !m.sendChanges(s, batch) {
+			m.closeSubscriber(s, ErrSubscriberLagged)
+		}
+	}
+}
+
+// sendChanges sends a batch to a subscriber. It returns false if a FeedDrop
+// subscriber could not accept the batch.
+func (m *Nitro) sendChanges(s *Subscription, batch *ChangeBatch) bool {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+
+	m.feed.emitLock.Lock()
+	skip := s.closed || (!s.started && snCompare(batch.Sn, s.startSn) <= 0)
+	if !skip {
+		s.started = true
+	}
+	m.feed.emitLock.Unlock()
+	if skip {
+		return true
+	}
+
+	if s.policy == FeedDrop {
+		select {
+		case s.ch <- batch:
+			return true
+		default:
+			return false
+		}
+	}
+
+	select {
+	case s.ch <- batch:
+	case <-s.done:
+	}
+
+	return true
+}
+
+// closeSubscriptions closes the subscriptions on shutdown
+func (m *Nitro) closeSubscriptions() {
+	m.feed.emitLock.Lock()
+	subs := append([]*Subscription(nil), m.feed.subs...)
+	m.feed.emitLock.Unlock()
+
+	for _, s := range subs {
+		m.closeSubscriber(s, nil)
+	}
+}
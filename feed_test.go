@@ -0,0 +1,238 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import "fmt"
+import "runtime"
+import "sort"
+import "sync"
+import "testing"
+import "time"
+
+func batchKeys(bss [][]byte) []string {
+	var keys []string
+	for _, bs := range bss {
+		keys = append(keys, string(bs))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestSubscribe(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w1 := db.NewWriter()
+	w2 := db.NewWriter()
+	w1.Put([]byte("a"))
+	w1.Put([]byte("b"))
+	snap, _ := db.NewSnapshot()
+	snap.Close()
+
+	sub := db.Subscribe(10, FeedBlock)
+	defer sub.Close()
+
+	// Changes of the current snapshot are not delivered
+	w1.Put([]byte("c"))
+	snap, _ = db.NewSnapshot()
+	snap.Close()
+	if sub.StartSn() != snap.sn {
+		t.Errorf("Expected start sn %d, got %d", snap.sn, sub.StartSn())
+	}
+
+	w1.Put([]byte("d"))
+	w2.Put([]byte("e"))
+	w2.Delete([]byte("a"))
+	// Insert and delete in the same snapshot cancel out
+	w1.Put([]byte("f"))
+	w2.Delete([]byte("f"))
+	w1.Upsert([]byte("b"))
+	snap, _ = db.NewSnapshot()
+	snap.Close()
+
+	batch := <-sub.Changes()
+	if batch.Sn != snap.Sn() || batch.SnGen != snap.SnGen() {
+		t.Errorf("Expected sn %d/%d, got %d/%d", snap.SnGen(), snap.Sn(), batch.SnGen, batch.Sn)
+	}
+
+	if ins := fmt.Sprint(batchKeys(batch.Inserted)); ins != "[b d e]" {
+		t.Errorf("Unexpected inserted items %s", ins)
+	}
+
+	if del := fmt.Sprint(batchKeys(batch.Deleted)); del != "[a b]" {
+		t.Errorf("Unexpected deleted items %s", del)
+	}
+
+	sub.Close()
+	if _, ok := <-sub.Changes(); ok {
+		t.Errorf("Expected closed channel")
+	}
+}
+
+func TestSubscribeLagged(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	sub := db.Subscribe(2, FeedDrop)
+	w := db.NewWriter()
+	for i := 0; i < 4; i++ {
+		w.Put([]byte(fmt.Sprintf("%d", i)))
+		snap, _ := db.NewSnapshot()
+		snap.Close()
+	}
+
+	n := 0
+	for range sub.Changes() {
+		n++
+	}
+
+	// The batch of the first snapshot is not delivered
+	if n != 2 {
+		t.Errorf("Expected 2 batches, got %d", n)
+	}
+
+	if sub.Err() != ErrSubscriberLagged {
+		t.Errorf("Expected lagged error, got %v", sub.Err())
+	}
+	sub.Close()
+}
+
+func TestSubscribeBlocked(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	sub := db.Subscribe(0, FeedBlock)
+	defer sub.Close()
+	snap, _ := db.NewSnapshot()
+	snap.Close()
+
+	w := db.NewWriter()
+	w.Put([]byte("a"))
+	done := make(chan struct{})
+	go func() {
+		snap, _ := db.NewSnapshot()
+		snap.Close()
+		close(done)
+	}()
+
+	// The subscriptions should be usable while NewSnapshot is blocked
+	time.Sleep(10 * time.Millisecond)
+	if err := sub.Err(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	sub.StartSn()
+	sub2 := db.Subscribe(1, FeedDrop)
+	defer sub2.Close()
+
+	batch := <-sub.Changes()
+	if ins := fmt.Sprint(batchKeys(batch.Inserted)); ins != "[a]" {
+		t.Errorf("Unexpected inserted items %s", ins)
+	}
+	<-done
+
+	// Close should unblock a pending send
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		sub.Close()
+	}()
+	snap, _ = db.NewSnapshot()
+	snap.Close()
+
+	w.Put([]byte("b"))
+	snap, _ = db.NewSnapshot()
+	snap.Close()
+	batch = <-sub2.Changes()
+	if ins := fmt.Sprint(batchKeys(batch.Inserted)); ins != "[b]" {
+		t.Errorf("Unexpected inserted items %s", ins)
+	}
+}
+
+func TestSubscribeConcurrentWrites(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		w := db.NewWriter()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			w.Put([]byte(fmt.Sprintf("%010d", i)))
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			snap, _ := db.NewSnapshot()
+			snap.Close()
+			runtime.Gosched()
+		}
+	}()
+
+	type result struct {
+		startSn, lastSn uint32
+		keys            map[string]bool
+	}
+
+	var results []result
+	for r := 0; r < 50; r++ {
+		sub := db.Subscribe(1000, FeedBlock)
+		res := result{startSn: sub.StartSn(), keys: make(map[string]bool)}
+		done := make(chan struct{})
+		go func() {
+			for batch := range sub.Changes() {
+				res.lastSn = batch.Sn
+				for _, bs := range batch.Inserted {
+					res.keys[string(bs)] = true
+				}
+			}
+			close(done)
+		}()
+
+		time.Sleep(2 * time.Millisecond)
+		sub.Close()
+		<-done
+		results = append(results, res)
+	}
+
+	close(stop)
+	wg.Wait()
+
+	// Every item written after the start of a subscription is delivered
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	itr := snap.NewIterator()
+	defer itr.Close()
+	for i, res := range results {
+		var missed int
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			itm := (*Item)(itr.GetNode().Item())
+			if itm.bornSn > res.startSn && itm.bornSn <= res.lastSn && !res.keys[string(itm.Bytes())] {
+				missed++
+			}
+		}
+
+		if missed > 0 {
+			t.Errorf("Subscription %d missed %d changes after sn %d", i, missed, res.startSn)
+		}
+	}
+}
@@ -11,12 +11,41 @@ package nitro
 
 import "os"
 import "bufio"
+import "bytes"
+import "compress/flate"
+import "encoding/binary"
 import "errors"
+import "fmt"
+import "hash/crc32"
+import "io"
+import "sync"
 
 var (
 	// DiskBlockSize - backup file reader and writer
 	DiskBlockSize     = 512 * 1024
 	errNotEnoughSpace = errors.New("Not enough space in the buffer")
+
+	// The magic starts with a zero length legacy record. Hence, it cannot
+	// be confused with the first record of a non-empty legacy file.
+	fileMagic = []byte("\x00\x00NITRO\x00")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+const (
+	// Legacy headerless format with [2 byte len][item_bytes] records
+	rawdbFileV1 = 1
+	// File header followed by [4 byte len][item_bytes] records
+	rawdbFileV2 = 2
+	// File header, checksummed blocks of records and footer
+	rawdbFileV3 = 3
+
+	fileHeaderSize   = 12
+	blockHeaderSize  = 8
+	fileFooterSize   = 12
+	blockCompressed  = 1 << 31
+	itemCountOffset  = 16
+	maxKeyCmpNameLen = 1024
 )
 
 // FileType describes backup file format
@@ -27,6 +56,8 @@ const (
 	readerBufSize = 10000
 	// RawdbFile - backup file storage format
 	RawdbFile FileType = iota
+	// CompressedFile - rawdb file format with compressed blocks
+	CompressedFile
 )
 
 // FileWriter represents backup file writer
@@ -43,61 +74,452 @@ type FileReader interface {
 	Close() error
 }
 
-func (m *Nitro) newFileWriter(t FileType) FileWriter {
-	var w FileWriter
-	if t == RawdbFile {
-		w = &rawFileWriter{db: m}
+// CorruptionError is returned by backup file readers when a file is damaged
+type CorruptionError struct {
+	Path   string
+	Offset int64
+	Reason string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("Backup file %s is corrupted at offset %d: %s", e.Path, e.Offset, e.Reason)
+}
+
+// FileWriterFactory creates a backup file writer for a Nitro instance
+type FileWriterFactory func(*Nitro) FileWriter
+
+// FileReaderFactory creates a backup file reader for a Nitro instance
+type FileReaderFactory func(*Nitro) FileReader
+
+type fileTypeEntry struct {
+	name          string
+	writerFactory FileWriterFactory
+	readerFactory FileReaderFactory
+}
+
+var (
+	fileTypesLock sync.RWMutex
+	nextFileType  = CompressedFile + 1
+	fileTypes     = map[FileType]fileTypeEntry{
+		RawdbFile: {
+			name: "rawdb",
+			writerFactory: func(m *Nitro) FileWriter {
+				return &rawFileWriter{db: m}
+			},
+			readerFactory: newRawFileReader,
+		},
+		CompressedFile: {
+			name: "rawdb-compressed",
+			writerFactory: func(m *Nitro) FileWriter {
+				return &rawFileWriter{db: m, compress: true}
+			},
+			// Compressed blocks are flagged in the block header. Hence, the
+			// same reader can read both the file types.
+			readerFactory: newRawFileReader,
+		},
+	}
+)
+
+// RegisterFileType adds a custom backup file format. The returned FileType
+// can be set using Config.SetFileType.
+// A FileReader returns a nil item at the end of the file. The items should
+// be created using Nitro.NewItem.
+func RegisterFileType(name string, wf FileWriterFactory, rf FileReaderFactory) (FileType, error) {
+	if name == "" || wf == nil || rf == nil {
+		return 0, fmt.Errorf("Invalid file type registration for %q", name)
+	}
+
+	fileTypesLock.Lock()
+	defer fileTypesLock.Unlock()
+
+	for _, e := range fileTypes {
+		if e.name == name {
+			return 0, fmt.Errorf("File type %q is already registered", name)
+		}
+	}
+
+	t := nextFileType
+	nextFileType++
+	fileTypes[t] = fileTypeEntry{name: name, writerFactory: wf, readerFactory: rf}
+	return t, nil
+}
+
+func lookupFileType(t FileType) (fileTypeEntry, error) {
+	fileTypesLock.RLock()
+	defer fileTypesLock.RUnlock()
+
+	e, ok := fileTypes[t]
+	if !ok {
+		return e, ErrUnknownFileType
+	}
+	return e, nil
+}
+
+func lookupFileTypeByName(name string) (FileType, error) {
+	fileTypesLock.RLock()
+	defer fileTypesLock.RUnlock()
+
+	for t, e := range fileTypes {
+		if e.name == name {
+			return t, nil
+		}
+	}
+	return 0, ErrUnknownFileType
+}
+
+// String returns the registered name of the file type
+func (t FileType) String() string {
+	if e, err := lookupFileType(t); err == nil {
+		return e.name
+	}
+	return fmt.Sprintf("FileType(%d)", int(t))
+}
+
+// NewFileWriter creates a backup file writer of a registered file type. A
+// custom file type can use it to wrap the built-in file formats.
+func (m *Nitro) NewFileWriter(t FileType) (FileWriter, error) {
+	e, err := lookupFileType(t)
+	if err != nil {
+		return nil, err
 	}
-	return w
+	return e.writerFactory(m), nil
 }
 
-func (m *Nitro) newFileReader(t FileType) FileReader {
-	var r FileReader
-	if t == RawdbFile {
-		r = &rawFileReader{db: m}
+// NewFileReader creates a backup file reader of a registered file type
+func (m *Nitro) NewFileReader(t FileType) (FileReader, error) {
+	e, err := lookupFileType(t)
+	if err != nil {
+		return nil, err
 	}
-	return r
+	return e.readerFactory(m), nil
+}
+
+func newRawFileReader(m *Nitro) FileReader {
+	return &rawFileReader{db: m}
 }
 
+// Rawdb file format (v3):
+//
+// Header: [8 byte magic][4 byte version][4 byte block size][8 byte item count]
+//         [2 byte key comparator name len][key comparator name][4 byte crc32c]
+// Blocks: [4 byte payload len][4 byte crc32c][payload] ... [0][0]
+// Footer: [8 byte item count][4 byte crc32c]
+//
+// The high bit of the payload len is set if the payload is compressed
+// using deflate. The crc covers the payload as stored in the file.
+// The payload of the blocks forms a stream of [4 byte len][item_bytes]
+// records terminated by a zero length record. A record may span blocks.
+// The item count in the header is updated when the file is closed.
+
 type rawFileWriter struct {
-	db   *Nitro
-	fd   *os.File
-	w    *bufio.Writer
-	buf  []byte
-	path string
+	db        *Nitro
+	fd        *os.File
+	w         io.Writer
+	body      *crcWriter
+	sum       fileChecksum
+	summed    bool
+	buf       []byte
+	path      string
+	hdr       []byte
+	block     []byte
+	blockUsed int
+	count     uint64
+
+	compress bool
+	cbuf     bytes.Buffer
+	cw       *flate.Writer
 }
 
 func (f *rawFileWriter) Open(path string) error {
 	var err error
-	f.fd, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0755)
-	if err == nil {
-		f.buf = make([]byte, encodeBufSize)
-		f.w = bufio.NewWriterSize(f.fd, DiskBlockSize)
+	f.fd, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+
+	f.path = path
+	f.init(f.fd)
+	if err = f.writeHeader(); err != nil {
+		return err
+	}
+
+	// The header is rewritten by Close. Hence, the checksum of the file is
+	// computed from the checksums of the header and the rest of the file.
+	f.body = &crcWriter{w: f.fd}
+	f.w = f.body
+	return nil
+}
+
+func (f *rawFileWriter) init(w io.Writer) {
+	f.w = w
+	f.buf = make([]byte, encodeBufSize)
+	f.block = make([]byte, blockHeaderSize+DiskBlockSize)
+}
+
+func (f *rawFileWriter) writeHeader() error {
+	name := f.db.keyCmpName
+	if len(name) > maxKeyCmpNameLen {
+		name = name[:maxKeyCmpNameLen]
+	}
+
+	f.hdr = make([]byte, fileHeaderSize+4+8+2+len(name)+4)
+	copy(f.hdr, fileMagic)
+	binary.BigEndian.PutUint32(f.hdr[fileHeaderSize-4:], rawdbFileV3)
+	binary.BigEndian.PutUint32(f.hdr[fileHeaderSize:], uint32(DiskBlockSize))
+	binary.BigEndian.PutUint16(f.hdr[itemCountOffset+8:], uint16(len(name)))
+	copy(f.hdr[itemCountOffset+10:], name)
+	f.updateHeaderCRC()
+
+	_, err := f.w.Write(f.hdr)
+	return err
+}
+
+func (f *rawFileWriter) updateHeaderCRC() {
+	l := len(f.hdr) - 4
+	binary.BigEndian.PutUint32(f.hdr[l:], crc32.Checksum(f.hdr[:l], crcTable))
+}
+
+// Write implements io.Writer for the block payload stream
+func (f *rawFileWriter) Write(bs []byte) (int, error) {
+	n := len(bs)
+	for len(bs) > 0 {
+		l := copy(f.block[blockHeaderSize+f.blockUsed:], bs)
+		f.blockUsed += l
+		bs = bs[l:]
+		if f.blockUsed == DiskBlockSize {
+			if err := f.flushBlock(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+func (f *rawFileWriter) flushBlock() error {
+	if f.blockUsed == 0 {
+		return nil
+	}
+
+	payload := f.block[blockHeaderSize : blockHeaderSize+f.blockUsed]
+	f.blockUsed = 0
+	if f.compress {
+		return f.writeCompressedBlock(payload)
+	}
+
+	binary.BigEndian.PutUint32(f.block[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(f.block[4:8], crc32.Checksum(payload, crcTable))
+	_, err := f.w.Write(f.block[:blockHeaderSize+len(payload)])
+	return err
+}
+
+// Blocks which do not shrink are stored uncompressed
+func (f *rawFileWriter) writeCompressedBlock(payload []byte) error {
+	var err error
+
+	f.cbuf.Reset()
+	f.cbuf.Write(make([]byte, blockHeaderSize))
+	if f.cw == nil {
+		f.cw, err = flate.NewWriter(&f.cbuf, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+	} else {
+		f.cw.Reset(&f.cbuf)
+	}
+
+	if _, err = f.cw.Write(payload); err != nil {
+		return err
+	}
+
+	if err = f.cw.Close(); err != nil {
+		return err
+	}
+
+	out := f.cbuf.Bytes()
+	flags := uint32(blockCompressed)
+	if len(out)-blockHeaderSize >= len(payload) {
+		out = f.block[:blockHeaderSize+len(payload)]
+		flags = 0
 	}
+
+	stored := out[blockHeaderSize:]
+	binary.BigEndian.PutUint32(out[0:4], uint32(len(stored))|flags)
+	binary.BigEndian.PutUint32(out[4:8], crc32.Checksum(stored, crcTable))
+	_, err = f.w.Write(out)
 	return err
 }
 
 func (f *rawFileWriter) WriteItem(itm *Item) error {
-	return f.db.EncodeItem(itm, f.buf, f.w)
+	if err := f.db.EncodeItem(itm, f.buf, f); err != nil {
+		return err
+	}
+
+	if itm.dataLen > 0 {
+		f.count++
+	}
+	return nil
 }
 
-func (f *rawFileWriter) Close() error {
+func (f *rawFileWriter) writeFooter() error {
+	if err := f.flushBlock(); err != nil {
+		return err
+	}
+
+	footer := make([]byte, blockHeaderSize+fileFooterSize)
+	binary.BigEndian.PutUint64(footer[blockHeaderSize:], f.count)
+	binary.BigEndian.PutUint32(footer[blockHeaderSize+8:],
+		crc32.Checksum(footer[blockHeaderSize:blockHeaderSize+8], crcTable))
+	_, err := f.w.Write(footer)
+	return err
+}
+
+// finish writes the terminator record and the footer
+func (f *rawFileWriter) finish() error {
 	terminator := &Item{}
 
 	if err := f.WriteItem(terminator); err != nil {
 		return err
 	}
 
-	f.w.Flush()
-	return f.fd.Close()
+	return f.writeFooter()
+}
+
+func (f *rawFileWriter) Close() error {
+	if err := f.finish(); err != nil {
+		f.fd.Close()
+		return err
+	}
+
+	binary.BigEndian.PutUint64(f.hdr[itemCountOffset:], f.count)
+	f.updateHeaderCRC()
+	if _, err := f.fd.WriteAt(f.hdr, 0); err != nil {
+		f.fd.Close()
+		return err
+	}
+
+	if err := f.fd.Close(); err != nil {
+		return err
+	}
+
+	f.sum = fileChecksum{
+		Size: int64(len(f.hdr)) + f.body.size,
+		CRC:  crc32Combine(crc32.Checksum(f.hdr, crcTable), f.body.crc, f.body.size),
+	}
+	f.summed = true
+	return nil
+}
+
+func (f *rawFileWriter) fileChecksum() (string, fileChecksum, bool) {
+	return f.path, f.sum, f.summed
+}
+
+// checksumFileWriter is implemented by the file writers which compute the
+// checksum of the file while it is written
+type checksumFileWriter interface {
+	fileChecksum() (path string, cs fileChecksum, ok bool)
+}
+
+// crcWriter computes the crc32c of the bytes written
+type crcWriter struct {
+	w    io.Writer
+	crc  uint32
+	size int64
+}
+
+func (c *crcWriter) Write(bs []byte) (int, error) {
+	n, err := c.w.Write(bs)
+	c.crc = crc32.Update(c.crc, crcTable, bs[:n])
+	c.size += int64(n)
+	return n, err
+}
+
+// crc32Combine returns the crc32c of the concatenation of two byte streams
+// given their checksums and the length of the second stream. It is the
+// crc32_combine() of zlib.
+func crc32Combine(crc1, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1
+	}
+
+	// Operator for a single zero bit
+	var even, odd [32]uint32
+	odd[0] = crc32.Castagnoli
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+
+	// Operators for two and four zero bits
+	gf2MatrixSquare(&even, &odd)
+	gf2MatrixSquare(&odd, &even)
+
+	// Apply len2 zero bytes to crc1
+	for {
+		gf2MatrixSquare(&even, &odd)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(&even, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+
+		gf2MatrixSquare(&odd, &even)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(&odd, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+	}
+
+	return crc1 ^ crc2
+}
+
+func gf2MatrixTimes(mat *[32]uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i, vec = i+1, vec>>1 {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+	}
+
+	return sum
+}
+
+func gf2MatrixSquare(square, mat *[32]uint32) {
+	for n := 0; n < 32; n++ {
+		square[n] = gf2MatrixTimes(mat, mat[n])
+	}
 }
 
 type rawFileReader struct {
-	db   *Nitro
-	fd   *os.File
-	r    *bufio.Reader
-	buf  []byte
-	path string
+	db      *Nitro
+	fd      *os.File
+	r       *bufio.Reader
+	buf     []byte
+	path    string
+	version uint32
+
+	blockSize  int
+	itemsCount uint64
+	count      uint64
+	done       bool
+	// Stream sections do not have a file header
+	streamed bool
+
+	// Block stream state
+	blkHdr    []byte
+	offset    int64
+	block     []byte
+	cblock    []byte
+	cr        io.ReadCloser
+	blockOff  int64
+	blockPos  int
+	lastBlock bool
 }
 
 func (f *rawFileReader) Open(path string) error {
@@ -105,13 +527,255 @@ func (f *rawFileReader) Open(path string) error {
 	f.fd, err = os.Open(path)
 	if err == nil {
 		f.buf = make([]byte, encodeBufSize)
+		f.blkHdr = make([]byte, blockHeaderSize)
 		f.r = bufio.NewReaderSize(f.fd, DiskBlockSize)
+		f.path = path
+		err = f.readHeader()
+	}
+	return err
+}
+
+func (f *rawFileReader) corruption(offset int64, format string, args ...interface{}) error {
+	return &CorruptionError{Path: f.path, Offset: offset, Reason: fmt.Sprintf(format, args...)}
+}
+
+// read reads exactly len(bs) bytes from the file and reports truncation
+// as a corruption
+func (f *rawFileReader) read(bs []byte, what string) error {
+	n, err := io.ReadFull(f.r, bs)
+	f.offset += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return f.corruption(f.offset-int64(n), "truncated %s", what)
+	}
+
+	return err
+}
+
+// Files without a header are in the legacy format
+func (f *rawFileReader) readHeader() error {
+	f.version = rawdbFileV1
+	magic, _ := f.r.Peek(len(fileMagic))
+	if !bytes.Equal(magic, fileMagic) {
+		return nil
+	}
+
+	hdr := make([]byte, fileHeaderSize)
+	if err := f.read(hdr, "file header"); err != nil {
+		return err
+	}
+
+	f.version = binary.BigEndian.Uint32(hdr[len(fileMagic):])
+	switch f.version {
+	case rawdbFileV2:
+		return nil
+	case rawdbFileV3:
+	default:
+		return fmt.Errorf("%s: unsupported file format version %d", f.path, f.version)
+	}
+
+	hdr = append(hdr, make([]byte, 4+8+2)...)
+	if err := f.read(hdr[fileHeaderSize:], "file header"); err != nil {
+		return err
+	}
+
+	nameLen := int(binary.BigEndian.Uint16(hdr[itemCountOffset+8:]))
+	if nameLen > maxKeyCmpNameLen {
+		return f.corruption(itemCountOffset+8, "invalid key comparator name length %d", nameLen)
+	}
+
+	hdr = append(hdr, make([]byte, nameLen+4)...)
+	if err := f.read(hdr[itemCountOffset+10:], "file header"); err != nil {
+		return err
+	}
+
+	l := len(hdr) - 4
+	if crc32.Checksum(hdr[:l], crcTable) != binary.BigEndian.Uint32(hdr[l:]) {
+		return f.corruption(0, "file header checksum mismatch")
+	}
+
+	f.blockSize = int(binary.BigEndian.Uint32(hdr[fileHeaderSize:]))
+	f.itemsCount = binary.BigEndian.Uint64(hdr[itemCountOffset:])
+	return f.db.checkKeyCmpName(f.path, string(hdr[itemCountOffset+10:l]))
+}
+
+// checkKeyCmpName verifies the key comparator name recorded in a backup. The
+// check is skipped if either comparator is unnamed.
+func (m *Nitro) checkKeyCmpName(path, name string) error {
+	if name != "" && m.keyCmpName != "" && name != m.keyCmpName {
+		return fmt.Errorf("%s: backup was written using key comparator %s, but %s is configured",
+			path, name, m.keyCmpName)
+	}
+
+	return nil
+}
+
+func (f *rawFileReader) readBlock() error {
+	hdr := f.blkHdr
+	blockOff := f.offset
+	if err := f.read(hdr, "block header"); err != nil {
+		return err
+	}
+
+	v := binary.BigEndian.Uint32(hdr[0:4])
+	l := int(v &^ blockCompressed)
+	compressed := v&blockCompressed != 0
+	if l == 0 {
+		// The end of blocks marker does not have a checksum
+		if v != 0 || binary.BigEndian.Uint32(hdr[4:8]) != 0 {
+			return f.corruption(blockOff, "invalid end of blocks marker")
+		}
+
+		f.lastBlock = true
+		return nil
+	}
+
+	if l > f.blockSize {
+		return f.corruption(blockOff, "invalid block length %d", l)
+	}
+
+	if cap(f.block) < f.blockSize {
+		f.block = make([]byte, f.blockSize)
+	}
+
+	stored := f.block[:l]
+	if compressed {
+		if cap(f.cblock) < f.blockSize {
+			f.cblock = make([]byte, f.blockSize)
+		}
+		stored = f.cblock[:l]
+	}
+
+	if err := f.read(stored, "block"); err != nil {
+		return err
+	}
+
+	if crc32.Checksum(stored, crcTable) != binary.BigEndian.Uint32(hdr[4:8]) {
+		return f.corruption(blockOff, "block checksum mismatch")
+	}
+
+	if compressed {
+		if err := f.decompressBlock(stored); err != nil {
+			return f.corruption(blockOff, "unable to decompress block: %v", err)
+		}
+	} else {
+		f.block = f.block[:l]
+	}
+
+	f.blockOff = blockOff + blockHeaderSize
+	f.blockPos = 0
+	return nil
+}
+
+func (f *rawFileReader) decompressBlock(stored []byte) error {
+	br := bytes.NewReader(stored)
+	if f.cr == nil {
+		f.cr = flate.NewReader(br)
+	} else if err := f.cr.(flate.Resetter).Reset(br, nil); err != nil {
+		return err
+	}
+
+	n, err := io.ReadFull(f.cr, f.block[:f.blockSize])
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	} else if err == nil {
+		// Decompressed data should fit in a block
+		var b [1]byte
+		if m, _ := f.cr.Read(b[:]); m > 0 {
+			err = errors.New("block too large")
+		}
 	}
+
+	f.block = f.block[:n]
 	return err
 }
 
+// Read implements io.Reader for the block payload stream
+func (f *rawFileReader) Read(bs []byte) (int, error) {
+	for f.blockPos == len(f.block) {
+		if f.lastBlock {
+			return 0, io.EOF
+		}
+
+		if err := f.readBlock(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(bs, f.block[f.blockPos:])
+	f.blockPos += n
+	return n, nil
+}
+
+func (f *rawFileReader) payloadOffset() int64 {
+	if f.blockPos == len(f.block) {
+		return f.offset
+	}
+
+	return f.blockOff + int64(f.blockPos)
+}
+
+func (f *rawFileReader) readFooter() error {
+	offset := f.payloadOffset()
+	if f.blockPos != len(f.block) {
+		return f.corruption(offset, "unexpected data after the last item")
+	}
+
+	if !f.lastBlock {
+		if err := f.readBlock(); err != nil {
+			return err
+		}
+
+		if !f.lastBlock {
+			return f.corruption(offset, "unexpected data after the last item")
+		}
+	}
+
+	footer := make([]byte, fileFooterSize)
+	offset = f.offset
+	if err := f.read(footer, "file footer"); err != nil {
+		return err
+	}
+
+	if crc32.Checksum(footer[:8], crcTable) != binary.BigEndian.Uint32(footer[8:]) {
+		return f.corruption(offset, "file footer checksum mismatch")
+	}
+
+	if c := binary.BigEndian.Uint64(footer[:8]); c != f.count || (!f.streamed && c != f.itemsCount) {
+		return f.corruption(offset, "item count mismatch (header=%d, footer=%d, read=%d)",
+			f.itemsCount, c, f.count)
+	}
+
+	return nil
+}
+
 func (f *rawFileReader) ReadItem() (*Item, error) {
-	return f.db.DecodeItem(f.buf, f.r)
+	switch f.version {
+	case rawdbFileV1:
+		return f.db.decodeItemV1(f.buf, f.r)
+	case rawdbFileV2:
+		return f.db.DecodeItem(f.buf, f.r)
+	}
+
+	if f.done {
+		return nil, nil
+	}
+
+	offset := f.payloadOffset()
+	itm, err := f.db.DecodeItem(f.buf, f)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = f.corruption(offset, "truncated item record")
+		}
+		return nil, err
+	}
+
+	if itm == nil {
+		f.done = true
+		return nil, f.readFooter()
+	}
+
+	f.count++
+	return itm, nil
 }
 
 func (f *rawFileReader) Close() error {
@@ -0,0 +1,175 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro_test
+
+import "bufio"
+import "encoding/hex"
+import "fmt"
+import "os"
+import "sync/atomic"
+import "testing"
+import "github.com/t3rm1n4l/nitro"
+
+type countingFileWriter struct {
+	nitro.FileWriter
+	count *int64
+}
+
+func (w *countingFileWriter) WriteItem(itm *nitro.Item) error {
+	atomic.AddInt64(w.count, 1)
+	return w.FileWriter.WriteItem(itm)
+}
+
+// hexFileWriter writes an item per line in hex
+type hexFileWriter struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func (w *hexFileWriter) Open(path string) (err error) {
+	if w.f, err = os.Create(path); err == nil {
+		w.w = bufio.NewWriter(w.f)
+	}
+	return
+}
+
+func (w *hexFileWriter) WriteItem(itm *nitro.Item) error {
+	_, err := fmt.Fprintln(w.w, hex.EncodeToString(itm.Bytes()))
+	return err
+}
+
+func (w *hexFileWriter) Close() error {
+	if err := w.w.Flush(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+type hexFileReader struct {
+	db *nitro.Nitro
+	f  *os.File
+	s  *bufio.Scanner
+}
+
+func (r *hexFileReader) Open(path string) (err error) {
+	if r.f, err = os.Open(path); err == nil {
+		r.s = bufio.NewScanner(r.f)
+	}
+	return
+}
+
+func (r *hexFileReader) ReadItem() (*nitro.Item, error) {
+	if !r.s.Scan() {
+		return nil, r.s.Err()
+	}
+
+	bs, err := hex.DecodeString(r.s.Text())
+	if err != nil {
+		return nil, err
+	}
+	return r.db.NewItem(bs), nil
+}
+
+func (r *hexFileReader) Close() error {
+	return r.f.Close()
+}
+
+func testFileType(t *testing.T, ft nitro.FileType, n int) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	conf := nitro.DefaultConfig()
+	if err := conf.SetFileType(ft); err != nil {
+		t.Fatal(err)
+	}
+
+	db := nitro.NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	db2 := nitro.NewWithConfig(conf)
+	defer db2.Close()
+	snap2, err := db2.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap2.Close()
+
+	i := 0
+	itr := snap2.NewIterator()
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if k := fmt.Sprintf("%010d", i); string(itr.Get()) != k {
+			t.Errorf("Expected %s, got %s", k, itr.Get())
+		}
+		i++
+	}
+
+	if i != n || snap2.Count() != int64(n) {
+		t.Errorf("Expected %d items, got %d (count %d)", n, i, snap2.Count())
+	}
+}
+
+func TestRegisterFileType(t *testing.T) {
+	var count int64
+	ft, err := nitro.RegisterFileType("counting",
+		func(m *nitro.Nitro) nitro.FileWriter {
+			w, _ := m.NewFileWriter(nitro.RawdbFile)
+			return &countingFileWriter{FileWriter: w, count: &count}
+		},
+		func(m *nitro.Nitro) nitro.FileReader {
+			r, _ := m.NewFileReader(nitro.RawdbFile)
+			return r
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := nitro.RegisterFileType("counting", nil, nil); err == nil {
+		t.Errorf("Expected an error for invalid registration")
+	}
+
+	conf := nitro.DefaultConfig()
+	if err := conf.SetFileType(ft + 1); err != nitro.ErrUnknownFileType {
+		t.Errorf("Expected unknown file type error, got %v", err)
+	}
+
+	n := 1000
+	testFileType(t, ft, n)
+	if int(count) != n {
+		t.Errorf("Expected %d items to be written, got %d", n, count)
+	}
+}
+
+func TestCustomFileType(t *testing.T) {
+	ft, err := nitro.RegisterFileType("hex",
+		func(m *nitro.Nitro) nitro.FileWriter {
+			return &hexFileWriter{}
+		},
+		func(m *nitro.Nitro) nitro.FileReader {
+			return &hexFileReader{db: m}
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testFileType(t, ft, 1000)
+}
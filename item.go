@@ -14,11 +14,17 @@ import (
 	"encoding/binary"
 	"io"
 	"reflect"
+	"sync"
 	"unsafe"
 )
 
 var itemHeaderSize = unsafe.Sizeof(Item{})
 
+// maxKeyItemBuf - larger search key buffers are not reused
+const maxKeyItemBuf = 64 * 1024
+
+var keyItemBufs = sync.Pool{New: func() interface{} { return new([]byte) }}
+
 // Item represents nitro item header
 // The item data is followed by the header.
 // Item data is a block of bytes. The user can store key and value into a
@@ -36,6 +42,35 @@ func (m *Nitro) newItem(data []byte, useMM bool) (itm *Item) {
 	return itm
 }
 
+// newKeyItem builds an item for searching the data in a reused buffer. The
+// item is only valid until the buffer is released using freeKeyItem.
+func newKeyItem(data []byte) (*Item, *[]byte) {
+	bufp := keyItemBufs.Get().(*[]byte)
+	l := int(itemHeaderSize) + len(data)
+	if cap(*bufp) < l {
+		*bufp = make([]byte, l)
+	}
+
+	itm := (*Item)(unsafe.Pointer(&(*bufp)[:l][0]))
+	itm.bornSn = 0
+	itm.deadSn = 0
+	itm.dataLen = uint32(len(data))
+	copy(itm.Bytes(), data)
+	return itm, bufp
+}
+
+func freeKeyItem(bufp *[]byte) {
+	if cap(*bufp) <= maxKeyItemBuf {
+		keyItemBufs.Put(bufp)
+	}
+}
+
+// NewItem allocates an item holding a copy of the data. The custom backup
+// file readers can use it to create the items read from a file.
+func (m *Nitro) NewItem(data []byte) *Item {
+	return m.newItem(data, m.useMemoryMgmt)
+}
+
 func (m *Nitro) freeItem(itm *Item) {
 	if m.useMemoryMgmt {
 		m.freeFun(unsafe.Pointer(itm))
@@ -57,15 +92,15 @@ func (m *Nitro) allocItem(l int, useMM bool) (itm *Item) {
 	return
 }
 
-// EncodeItem encodes in [2 byte len][item_bytes] format.
+// EncodeItem encodes in [4 byte len][item_bytes] format.
 func (m *Nitro) EncodeItem(itm *Item, buf []byte, w io.Writer) error {
-	l := 2
+	l := 4
 	if len(buf) < l {
 		return errNotEnoughSpace
 	}
 
-	binary.BigEndian.PutUint16(buf[0:2], uint16(itm.dataLen))
-	if _, err := w.Write(buf[0:2]); err != nil {
+	binary.BigEndian.PutUint32(buf[0:4], itm.dataLen)
+	if _, err := w.Write(buf[0:4]); err != nil {
 		return err
 	}
 	if _, err := w.Write(itm.Bytes()); err != nil {
@@ -75,18 +110,35 @@ func (m *Nitro) EncodeItem(itm *Item, buf []byte, w io.Writer) error {
 	return nil
 }
 
-// DecodeItem decodes encoded [2 byte len][item_bytes] format.
+// DecodeItem decodes encoded [4 byte len][item_bytes] format.
 func (m *Nitro) DecodeItem(buf []byte, r io.Reader) (*Item, error) {
+	if _, err := io.ReadFull(r, buf[0:4]); err != nil {
+		return nil, err
+	}
+
+	l := binary.BigEndian.Uint32(buf[0:4])
+	return m.decodeItemData(int(l), r)
+}
+
+// decodeItemV1 decodes the legacy [2 byte len][item_bytes] format.
+func (m *Nitro) decodeItemV1(buf []byte, r io.Reader) (*Item, error) {
 	if _, err := io.ReadFull(r, buf[0:2]); err != nil {
 		return nil, err
 	}
 
 	l := binary.BigEndian.Uint16(buf[0:2])
+	return m.decodeItemData(int(l), r)
+}
+
+func (m *Nitro) decodeItemData(l int, r io.Reader) (*Item, error) {
 	if l > 0 {
-		itm := m.allocItem(int(l), m.useMemoryMgmt)
+		itm := m.allocItem(l, m.useMemoryMgmt)
 		data := itm.Bytes()
-		_, err := io.ReadFull(r, data)
-		return itm, err
+		if _, err := io.ReadFull(r, data); err != nil {
+			m.freeItem(itm)
+			return nil, err
+		}
+		return itm, nil
 	}
 
 	return nil, nil
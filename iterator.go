@@ -11,6 +11,7 @@ package nitro
 
 import (
 	"github.com/t3rm1n4l/nitro/skiplist"
+	"math"
 	"unsafe"
 )
 
@@ -22,6 +23,23 @@ type Iterator struct {
 	snap *Snapshot
 	iter *skiplist.Iterator
 	buf  *skiplist.ActionBuffer
+
+	// Range iterator bounds
+	start, end   []byte
+	inclusiveEnd bool
+	outOfRange   bool
+
+	// Selects the items returned by the iterator. Items visible in the
+	// snapshot are returned if it is not set.
+	filter func(*Item) bool
+}
+
+func (it *Iterator) wanted(itm *Item) bool {
+	if it.filter != nil {
+		return it.filter(itm)
+	}
+
+	return it.snap.isVisible(itm)
 }
 
 func (it *Iterator) skipUnwanted() {
@@ -30,30 +48,100 @@ loop:
 		return
 	}
 	itm := (*Item)(it.iter.Get())
-	if itm.bornSn > it.snap.sn || (itm.deadSn > 0 && itm.deadSn <= it.snap.sn) {
+	if !it.wanted(itm) {
 		it.iter.Next()
 		it.count++
 		goto loop
 	}
 }
 
+func (it *Iterator) skipUnwantedPrev() {
+	for it.iter.Valid() && !it.wanted((*Item)(it.iter.Get())) {
+		it.iter.Prev()
+		it.count++
+	}
+}
+
+func (it *Iterator) checkEnd() {
+	it.outOfRange = false
+	if it.end != nil && it.iter.Valid() {
+		v := it.snap.db.keyCmp((*Item)(it.iter.Get()).Bytes(), it.end)
+		it.outOfRange = v > 0 || (v == 0 && !it.inclusiveEnd)
+	}
+}
+
+func (it *Iterator) checkStart() {
+	it.outOfRange = false
+	if it.start != nil && it.iter.Valid() {
+		it.outOfRange = it.snap.db.keyCmp((*Item)(it.iter.Get()).Bytes(), it.start) < 0
+	}
+}
+
 // SeekFirst moves cursor to the beginning
 func (it *Iterator) SeekFirst() {
+	if it.start != nil {
+		it.Seek(it.start)
+		return
+	}
+
 	it.iter.SeekFirst()
 	it.skipUnwanted()
+	it.checkEnd()
 }
 
 // Seek to a specified key or the next bigger one if an item with key does not
 // exist.
 func (it *Iterator) Seek(bs []byte) {
-	itm := it.snap.db.newItem(bs, false)
+	if it.start != nil && it.snap.db.keyCmp(bs, it.start) < 0 {
+		bs = it.start
+	}
+
+	itm, buf := newKeyItem(bs)
+	defer freeKeyItem(buf)
 	it.iter.Seek(unsafe.Pointer(itm))
 	it.skipUnwanted()
+	it.checkEnd()
+}
+
+// SeekLast moves cursor to the last item
+func (it *Iterator) SeekLast() {
+	if it.end == nil {
+		it.iter.SeekLast()
+		it.skipUnwantedPrev()
+		it.checkStart()
+		return
+	}
+
+	it.seekForPrev(it.end)
+	if !it.inclusiveEnd && it.Valid() && it.snap.db.keyCmp(it.Get(), it.end) == 0 {
+		it.Prev()
+	}
+}
+
+// SeekForPrev seeks to a specified key or the previous smaller one if an item
+// with key does not exist.
+func (it *Iterator) SeekForPrev(bs []byte) {
+	if it.end != nil && it.snap.db.keyCmp(bs, it.end) >= 0 {
+		it.SeekLast()
+		return
+	}
+
+	it.seekForPrev(bs)
+}
+
+func (it *Iterator) seekForPrev(bs []byte) {
+	// Position after all the versions of the item
+	itm, buf := newKeyItem(bs)
+	defer freeKeyItem(buf)
+	itm.bornSn = math.MaxUint32
+	it.iter.SeekForPrev(unsafe.Pointer(itm))
+	it.skipUnwantedPrev()
+	it.checkStart()
 }
 
 // Valid eturns false when the iterator has reached the end.
 func (it *Iterator) Valid() bool {
-	return it.iter.Valid()
+	return it.iter.Valid() && !it.outOfRange
 }
 
 // Get eturns the current item data from the iterator.
@@ -71,6 +159,19 @@ func (it *Iterator) Next() {
 	it.iter.Next()
 	it.count++
 	it.skipUnwanted()
+	it.checkEnd()
+	if it.refreshRate > 0 && it.count > it.refreshRate {
+		it.Refresh()
+		it.count = 0
+	}
+}
+
+// Prev moves iterator cursor to the previous item
+func (it *Iterator) Prev() {
+	it.iter.Prev()
+	it.count++
+	it.skipUnwantedPrev()
+	it.checkStart()
 	if it.refreshRate > 0 && it.count > it.refreshRate {
 		it.Refresh()
 		it.count = 0
@@ -84,7 +185,7 @@ func (it *Iterator) Refresh() {
 	if it.Valid() {
 		itm := it.snap.db.ptrToItem(it.GetNode().Item())
 		it.iter.Close()
-		it.iter = it.snap.db.store.NewIterator(it.snap.db.iterCmp, it.buf)
+		it.iter = it.snap.db.store.NewIterator(it.snap.db.insCmp, it.buf)
 		it.iter.Seek(unsafe.Pointer(itm))
 	}
 }
@@ -109,9 +210,118 @@ func (m *Nitro) NewIterator(snap *Snapshot) *Iterator {
 		return nil
 	}
 	buf := snap.db.store.MakeBuf()
+	// Item versions are ordered by bornSn. The insert comparator enables the
+	// reverse iteration to find the exact predecessor among the versions.
 	return &Iterator{
 		snap: snap,
-		iter: m.store.NewIterator(m.iterCmp, buf),
+		iter: m.store.NewIterator(m.insCmp, buf),
 		buf:  buf,
 	}
 }
+
+// NewRangeIterator creates an iterator for the items in the [start, end) key
+// range of a Nitro snapshot. The end key is included in the range if
+// inclusiveEnd is set. A nil start or end denotes an unbounded range on that
+// side. Valid() returns false once the iterator moves past the end key.
+func (m *Nitro) NewRangeIterator(snap *Snapshot, start, end []byte, inclusiveEnd bool) *Iterator {
+	it := m.NewIterator(snap)
+	if it != nil {
+		it.start = start
+		it.end = end
+		it.inclusiveEnd = inclusiveEnd
+	}
+
+	return it
+}
+
+// NewRangeIterator creates a new snapshot iterator bounded by a key range
+func (s *Snapshot) NewRangeIterator(start, end []byte, inclusiveEnd bool) *Iterator {
+	return s.db.NewRangeIterator(s, start, end, inclusiveEnd)
+}
+
+// NewPrefixIterator creates a new snapshot iterator for the items having
+// the given prefix. It assumes that the key comparator orders the items
+// by their raw bytes as done by the default comparator.
+func (s *Snapshot) NewPrefixIterator(prefix []byte) *Iterator {
+	if prefix == nil {
+		prefix = []byte{}
+	}
+	return s.db.NewRangeIterator(s, prefix, prefixEnd(prefix), false)
+}
+
+// prefixEnd returns the smallest key greater than all the keys having the
+// prefix. It returns nil if there is no such key.
+func prefixEnd(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xff {
+			end := make([]byte, i+1)
+			copy(end, prefix)
+			end[i]++
+			return end
+		}
+	}
+
+	return nil
+}
+
+// DiffType describes the change of an item between two snapshots
+type DiffType int
+
+const (
+	// DiffAdded means the item is visible only in the newer snapshot
+	DiffAdded DiffType = iota
+	// DiffRemoved means the item is visible only in the older snapshot
+	DiffRemoved
+)
+
+// DiffIterator iterates over the items changed between two snapshots
+type DiffIterator struct {
+	*Iterator
+	older *Snapshot
+}
+
+// changedSince returns a filter for the items whose visibility differs
+// between the snapshot and an older snapshot number
+func changedSince(sn uint32, snap *Snapshot) func(*Item) bool {
+	older := Snapshot{sn: sn}
+	return func(itm *Item) bool {
+		return snap.isVisible(itm) != older.isVisible(itm)
+	}
+}
+
+// NewDiffIterator creates an iterator for the items added or removed between
+// two snapshots of a Nitro instance. An item which was added and then removed
+// between the snapshots is not returned.
+func (m *Nitro) NewDiffIterator(older, newer *Snapshot) (*DiffIterator, error) {
+	if older.db != m || newer.db != m || snCompare(older.sn, newer.sn) >= 0 {
+		return nil, ErrInvalidDiffSnapshots
+	}
+
+	if !older.Open() {
+		return nil, ErrInvalidDiffSnapshots
+	}
+
+	it := m.NewIterator(newer)
+	if it == nil {
+		older.Close()
+		return nil, ErrInvalidDiffSnapshots
+	}
+
+	it.filter = changedSince(older.sn, newer)
+	return &DiffIterator{Iterator: it, older: older}, nil
+}
+
+// Type returns the change type of the current item
+func (it *DiffIterator) Type() DiffType {
+	if it.snap.isVisible((*Item)(it.iter.Get())) {
+		return DiffAdded
+	}
+
+	return DiffRemoved
+}
+
+// Close executes destructor for diff iterator
+func (it *DiffIterator) Close() {
+	it.Iterator.Close()
+	it.older.Close()
+}
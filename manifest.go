@@ -0,0 +1,488 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const manifestFile = "manifest.json"
+
+// fileChecksum describes a file in the backup directory
+type fileChecksum struct {
+	Size int64
+	CRC  uint32
+}
+
+// backupManifest describes the snapshot stored in a backup directory.
+// It is written after all the other files in the backup directory.
+type backupManifest struct {
+	Sn uint32
+	// Generation of the snapshot numbers. It is incremented when the
+	// snapshot numbers wrap around.
+	SnGen      uint32 `json:",omitempty"`
+	BaseSn     uint32 `json:",omitempty"`
+	ItemsCount int64
+	FileType   string
+	Files      []string
+
+	// Checksums of all the files in the backup directory
+	Checksums map[string]fileChecksum
+	// Checksum of the manifest computed with this field set to zero
+	Checksum uint32
+}
+
+func (man *backupManifest) computeChecksum() uint32 {
+	cs := man.Checksum
+	man.Checksum = 0
+	bs, _ := json.Marshal(man)
+	man.Checksum = cs
+	return crc32.Checksum(bs, crcTable)
+}
+
+// checksumFile computes the checksum of a file. The file is flushed to the
+// disk if sync is set.
+func checksumFile(path string, sync bool) (fileChecksum, error) {
+	var cs fileChecksum
+	f, err := os.Open(path)
+	if err != nil {
+		return cs, err
+	}
+	defer f.Close()
+
+	h := crc32.New(crcTable)
+	if cs.Size, err = io.Copy(h, f); err != nil {
+		return cs, err
+	}
+	cs.CRC = h.Sum32()
+
+	if sync {
+		err = f.Sync()
+	}
+
+	return cs, err
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
+
+// fileChecksums collects the checksums computed by the file writers so that
+// the files need not be read again for the manifest
+type fileChecksums struct {
+	sync.Mutex
+	sums map[string]fileChecksum
+}
+
+func newFileChecksums() *fileChecksums {
+	return &fileChecksums{sums: make(map[string]fileChecksum)}
+}
+
+func (c *fileChecksums) get(path string) (fileChecksum, bool) {
+	if c == nil {
+		return fileChecksum{}, false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	cs, ok := c.sums[filepath.Clean(path)]
+	return cs, ok
+}
+
+// closeFileWriter closes a backup file writer and records the checksum of
+// the file if the writer has computed it
+func closeFileWriter(w FileWriter, sums *fileChecksums) error {
+	if tw, ok := w.(*trackedFileWriter); ok {
+		w = tw.FileWriter
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	if cw, ok := w.(checksumFileWriter); ok && sums != nil {
+		if path, cs, ok := cw.fileChecksum(); ok {
+			sums.Lock()
+			sums.sums[filepath.Clean(path)] = cs
+			sums.Unlock()
+		}
+	}
+
+	return nil
+}
+
+// writeManifest flushes the files in the backup directory to the disk and
+// writes the manifest with their checksums. The files whose checksums are
+// not known from sums are read to compute the checksums.
+func writeManifest(dir string, man *backupManifest, sums *fileChecksums) error {
+	var dirs []string
+
+	man.Checksums = make(map[string]fileChecksum)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			dirs = append(dirs, path)
+			return nil
+		}
+
+		if fi.Name() == manifestFile+".tmp" {
+			return nil
+		}
+
+		cs, ok := sums.get(path)
+		if ok {
+			err = syncFile(path)
+		} else {
+			cs, err = checksumFile(path, true)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(dir, path)
+		man.Checksums[filepath.ToSlash(rel)] = cs
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	man.Checksum = man.computeChecksum()
+	bs, err := json.Marshal(man)
+	if err != nil {
+		return err
+	}
+
+	// The manifest is renamed into place so that an existing directory
+	// never has a partially written manifest
+	tmp := filepath.Join(dir, manifestFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(bs); err == nil {
+		err = f.Sync()
+	}
+
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, manifestFile))
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	for _, d := range dirs {
+		if err := syncDir(d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
+
+// readManifest recovers an interrupted backup directory replace and reads
+// the backup manifest
+func readManifest(dir string) (*backupManifest, error) {
+	if err := recoverBackupDir(dir); err != nil {
+		return nil, err
+	}
+
+	return parseManifest(dir)
+}
+
+// verifyFileChecksums verifies the sizes and the checksums of the files in
+// the backup directory
+func verifyFileChecksums(dir string, man *backupManifest) error {
+	for _, file := range man.checksumFiles() {
+		cs := man.Checksums[file]
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		got, err := checksumFile(path, false)
+		if err != nil {
+			return err
+		}
+
+		if got.Size != cs.Size {
+			return &CorruptionError{
+				Path:   path,
+				Offset: got.Size,
+				Reason: fmt.Sprintf("file size mismatch (expected %d)", cs.Size),
+			}
+		}
+
+		if got.CRC != cs.CRC {
+			return &CorruptionError{Path: path, Reason: "file checksum mismatch"}
+		}
+	}
+
+	return nil
+}
+
+// checksumFiles returns the files having checksums in the sorted order
+func (man *backupManifest) checksumFiles() []string {
+	var files []string
+	for file := range man.Checksums {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	return files
+}
+
+// parseManifest reads the backup manifest and validates its checksum
+func parseManifest(dir string) (*backupManifest, error) {
+	var man backupManifest
+
+	bs, err := ioutil.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrInvalidBackup
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(bs, &man); err != nil || man.Checksum != man.computeChecksum() {
+		return nil, &CorruptionError{
+			Path:   filepath.Join(dir, manifestFile),
+			Reason: "invalid manifest",
+		}
+	}
+
+	return &man, nil
+}
+
+// UpgradeBackup writes a manifest for a backup directory written by an older
+// version which did not write a manifest. Such a directory cannot be loaded
+// by LoadFromDisk until it is upgraded. The backup files are read using the
+// file type of the config to count the items and a truncated or corrupted
+// file fails the upgrade. The snapshot number of the backup is unknown and
+// hence the restored instance starts from the first snapshot. A directory
+// having a valid manifest is left unchanged.
+func UpgradeBackup(dir string, cfg Config) error {
+	if _, err := parseManifest(dir); err != ErrInvalidBackup {
+		return err
+	}
+
+	datadir := filepath.Join(dir, "data")
+	files, err := readFileList(datadir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrInvalidBackup
+		}
+		return err
+	}
+
+	// The instance is used only for decoding the items
+	cfg.walDir = ""
+	m := NewWithConfig(cfg)
+	defer m.Close()
+
+	var count int64
+	concurr := runtime.NumCPU()
+	err = m.readFiles(context.Background(), datadir, files, cfg.fileType, concurr, nil,
+		func(_, _ int, itm *Item) error {
+			atomic.AddInt64(&count, 1)
+			m.freeItem(itm)
+			return nil
+		})
+
+	if err != nil {
+		return err
+	}
+
+	deltadir := filepath.Join(dir, "delta")
+	if files, err := readFileList(deltadir); err == nil {
+		err = m.readFiles(context.Background(), deltadir, files, cfg.fileType, concurr, nil,
+			func(_, _ int, itm *Item) error {
+				m.freeItem(itm)
+				return nil
+			})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeManifest(dir, &backupManifest{
+		ItemsCount: count,
+		FileType:   cfg.fileType.String(),
+		Files:      files,
+	}, nil)
+}
+
+// Temporary backup directories of the backups in progress
+var activeBackupDirs = struct {
+	sync.Mutex
+	dirs map[string]bool
+}{dirs: make(map[string]bool)}
+
+// newBackupDir creates a temporary directory next to the backup directory
+func newBackupDir(dir string) (string, error) {
+	dir = filepath.Clean(dir)
+	parent := filepath.Dir(dir)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", err
+	}
+
+	activeBackupDirs.Lock()
+	defer activeBackupDirs.Unlock()
+	tmpdir, err := ioutil.TempDir(parent, filepath.Base(dir)+".tmp")
+	if err == nil {
+		activeBackupDirs.dirs[filepath.Clean(tmpdir)] = true
+	}
+
+	return tmpdir, err
+}
+
+// commitBackup writes the manifest into the temporary backup directory and
+// renames it to the backup directory. An existing backup directory is
+// replaced. The temporary directory is removed on failure.
+func commitBackup(tmpdir, dir string, man *backupManifest, sums *fileChecksums, err error) error {
+	if err == nil {
+		err = writeManifest(tmpdir, man, sums)
+	}
+
+	if err == nil {
+		err = replaceDir(tmpdir, filepath.Clean(dir))
+	}
+
+	if err != nil {
+		os.RemoveAll(tmpdir)
+	}
+
+	activeBackupDirs.Lock()
+	delete(activeBackupDirs.dirs, filepath.Clean(tmpdir))
+	activeBackupDirs.Unlock()
+	return err
+}
+
+// replaceDir renames src to dst. An existing dst is moved aside to dst.old
+// until the rename is done. recoverBackupDir completes or rolls back an
+// interrupted replace.
+func replaceDir(src, dst string) error {
+	if err := recoverBackupDir(dst); err != nil {
+		return err
+	}
+
+	old := dst + ".old"
+	if _, err := os.Stat(dst); err == nil {
+		if err := os.Rename(dst, old); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(src, dst); err != nil {
+		os.Rename(old, dst)
+		return err
+	}
+
+	if err := syncDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(old)
+}
+
+// recoverBackupDir recovers a backup directory from a crash during
+// replaceDir. If the backup directory is missing, the old backup directory
+// is restored. Otherwise, the old backup directory is removed. The temporary
+// directories left by the interrupted backups are removed.
+func recoverBackupDir(dir string) error {
+	dir = filepath.Clean(dir)
+	if err := removeStaleBackupDirs(dir); err != nil {
+		return err
+	}
+
+	old := dir + ".old"
+	if _, err := os.Stat(old); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if _, err := os.Stat(dir); err == nil {
+		return os.RemoveAll(old)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Rename(old, dir); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(dir))
+}
+
+// removeStaleBackupDirs removes the temporary directories of a backup
+// directory which do not belong to a backup in progress
+func removeStaleBackupDirs(dir string) error {
+	parent := filepath.Dir(dir)
+	prefix := filepath.Base(dir) + ".tmp"
+	fis, err := ioutil.ReadDir(parent)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	activeBackupDirs.Lock()
+	defer activeBackupDirs.Unlock()
+	for _, fi := range fis {
+		path := filepath.Join(parent, fi.Name())
+		if fi.IsDir() && strings.HasPrefix(fi.Name(), prefix) && !activeBackupDirs.dirs[path] {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
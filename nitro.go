@@ -11,6 +11,7 @@ package nitro
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -23,6 +24,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -30,12 +32,74 @@ import (
 )
 
 var (
-	// ErrMaxSnapshotsLimitReached means 32 bit integer overflow of snap number
+	// ErrMaxSnapshotsLimitReached means the snapshot numbers in use span the
+	// maximum range as an old snapshot has been kept open
 	ErrMaxSnapshotsLimitReached = fmt.Errorf("Maximum snapshots limit reached")
 	// ErrShutdown means an operation on a shutdown Nitro instance
 	ErrShutdown = fmt.Errorf("Nitro instance has been shutdown")
+	// ErrInvalidRange means the start key of a range is greater than the end key
+	ErrInvalidRange = fmt.Errorf("Invalid key range")
+	// ErrUnknownFileType means the backup file type is not supported
+	ErrUnknownFileType = fmt.Errorf("Unknown backup file type")
+	// ErrInvalidIncrementalBase means the base snapshot of an incremental
+	// backup is not available
+	ErrInvalidIncrementalBase = fmt.Errorf("Invalid base snapshot for incremental backup")
+	// ErrIncrementalBackup means an incremental backup was used as a full backup
+	ErrIncrementalBackup = fmt.Errorf("Backup is an incremental backup")
+	// ErrInvalidBackup means the backup directory does not have a valid manifest
+	ErrInvalidBackup = fmt.Errorf("Invalid backup directory")
+	// ErrInvalidStream means the data is not a backup stream
+	ErrInvalidStream = fmt.Errorf("Invalid backup stream")
+	// ErrWALNotEnabled means write ahead logging is not configured
+	ErrWALNotEnabled = fmt.Errorf("Write ahead log is not enabled")
+	// ErrInvalidDiffSnapshots means the snapshots cannot be compared
+	ErrInvalidDiffSnapshots = fmt.Errorf("Invalid snapshots for diff")
+	// ErrSnapshotNotFound means the snapshot is not live anymore
+	ErrSnapshotNotFound = fmt.Errorf("Snapshot not found")
 )
 
+// The snapshot numbers wrap around and they are compared using serial number
+// arithmetic. Hence, the snapshot numbers in use should be within 2^31 of
+// each other. The bornSn of the items older than the oldest snapshot is
+// moved up by a background scan once in snAgeInterval snapshots. NewSnapshot
+// fails once the oldest snapshot number in use is snMaxRange snapshots old.
+var (
+	snAgeInterval uint32 = 1 << 28
+	snMaxRange    uint32 = 1 << 30
+)
+
+// snCompare compares the snapshot numbers a and b
+func snCompare(a, b uint32) int {
+	return int(int32(a - b))
+}
+
+// nextSn returns the snapshot number following sn. The snapshot numbers skip
+// 0 and math.MaxUint32 on wrapping around. It retains the alternating parity
+// of the snapshot numbers used to select the writer epochs.
+func nextSn(sn uint32) uint32 {
+	if sn++; sn == math.MaxUint32 {
+		sn = 1
+	}
+
+	return sn
+}
+
+// compareBornSn orders the item versions by bornSn. The bornSn 0 of the
+// restored items and the search keys precedes all the snapshot numbers and
+// math.MaxUint32 follows them.
+func compareBornSn(a, b uint32) int {
+	switch {
+	case a == b:
+		return 0
+	case a == 0 || b == math.MaxUint32:
+		return -1
+	case b == 0 || a == math.MaxUint32:
+		return 1
+	}
+
+	return snCompare(a, b)
+}
+
 // KeyCompare implements item data key comparator
 type KeyCompare func([]byte, []byte) int
 
@@ -99,7 +163,7 @@ func newInsertCompare(keyCmp KeyCompare) skiplist.CompareFn {
 		thisItem := (*Item)(this)
 		thatItem := (*Item)(that)
 		if v = keyCmp(thisItem.Bytes(), thatItem.Bytes()); v == 0 {
-			v = int(thisItem.bornSn) - int(thatItem.bornSn)
+			v = compareBornSn(thisItem.bornSn, thatItem.bornSn)
 		}
 
 		return v
@@ -151,25 +215,77 @@ func (ctx *deltaWrContext) Init() {
 	ctx.closed = make(chan struct{})
 }
 
+// writerEpoch holds the writer state for the writes performed in a snapshot.
+// It is handed over to NewSnapshot once the snapshot is created.
+type writerEpoch struct {
+	gchead *skiplist.Node
+	gctail *skiplist.Node
+	count  int64
+	slSts  skiplist.Stats
+
+	feedEvents []feedEvent
+}
+
 // Writer provides a handle for concurrent access
 // Nitro writer is thread-unsafe and should initialize separate Nitro writers
 // to perform concurrent writes from multiple threads.
 type Writer struct {
 	dwrCtx deltaWrContext // Used for cooperative disk snapshotting
 
-	rand   *rand.Rand
-	buf    *skiplist.ActionBuffer
-	gchead *skiplist.Node
-	gctail *skiplist.Node
-	next   *Writer
-	// Local skiplist stats for writer, gcworker and freeworker
-	slSts1, slSts2, slSts3 skiplist.Stats
-	resSts                 restoreStats
-	count                  int64
+	rand *rand.Rand
+	buf  *skiplist.ActionBuffer
+	next *Writer
+
+	// Writer operations with sn use epochs[sn&1]. The writer state for
+	// sn is not modified once currSn moves past sn and activeSn is cleared.
+	activeSn uint32
+	epochs   [2]writerEpoch
+	ep       *writerEpoch
+
+	// Local skiplist stats for gcworker and freeworker
+	slSts2, slSts3 skiplist.Stats
+	resSts         restoreStats
+
+	walLog *walLog
+	walOff bool
+	// Nesting depth of the batch operations syncing the log once
+	walBatch int
+	// Records logged with WALSyncAlways are pending a sync
+	walUnsynced bool
+
+	closed int32
+	stop   chan struct{}
 
 	*Nitro
 }
 
+// enterEpoch marks the writer as active in the current snapshot and returns
+// the snapshot number to be used by the operation.
+func (w *Writer) enterEpoch() uint32 {
+	for {
+		sn := w.getCurrSn()
+		atomic.StoreUint32(&w.activeSn, sn)
+		// NewSnapshot may have moved currSn before it could see activeSn
+		if w.getCurrSn() == sn && atomic.LoadInt32(&w.wrapping) == 0 {
+			w.ep = &w.epochs[sn&1]
+			return sn
+		}
+
+		atomic.StoreUint32(&w.activeSn, 0)
+		runtime.Gosched()
+	}
+}
+
+func (w *Writer) exitEpoch() {
+	atomic.StoreUint32(&w.activeSn, 0)
+
+	// The log is synced outside the epoch so that NewSnapshot does not
+	// wait for it
+	if w.walUnsynced && w.walBatch == 0 {
+		w.syncWAL()
+	}
+}
+
 func (w *Writer) doCheckpoint() {
 	ctx := &w.dwrCtx
 	switch ctx.state {
@@ -186,7 +302,7 @@ func (w *Writer) doCheckpoint() {
 func (w *Writer) doDeltaWrite(itm *Item) {
 	ctx := &w.dwrCtx
 	if ctx.state == dwStateActive {
-		if itm.bornSn <= ctx.sn && itm.deadSn > ctx.sn {
+		if isVisibleAt(itm, ctx.sn) {
 			if err := ctx.fw.WriteItem(itm); err != nil {
 				ctx.err = err
 			}
@@ -204,11 +320,15 @@ func (w *Writer) Put(bs []byte) {
 func (w *Writer) Put2(bs []byte) (n *skiplist.Node) {
 	var success bool
 	x := w.newItem(bs, w.useMemoryMgmt)
-	x.bornSn = w.getCurrSn()
+	x.bornSn = w.enterEpoch()
+	defer w.exitEpoch()
+
 	n, success = w.store.Insert2(unsafe.Pointer(x), w.insCmp, w.existCmp, w.buf,
-		w.rand.Float32, &w.slSts1)
+		w.rand.Float32, &w.ep.slSts)
 	if success {
-		w.count++
+		w.ep.count++
+		w.logWAL(walPut, x.bornSn, bs)
+		w.recordChange(feedInsert, bs)
 	} else {
 		w.freeItem(x)
 	}
@@ -234,17 +354,38 @@ func (w *Writer) Delete2(bs []byte) (n *skiplist.Node, success bool) {
 // DeleteNode deletes an item by specifying its skiplist Node.
 // Using this API can avoid a O(logn) lookup during Delete().
 func (w *Writer) DeleteNode(x *skiplist.Node) (success bool) {
+	sn := w.enterEpoch()
+	defer w.exitEpoch()
+
+	var bs []byte
+	if w.wal != nil && !w.walOff {
+		// The item may be freed after it is deleted
+		bs = append([]byte(nil), (*Item)(x.Item()).Bytes()...)
+	}
+
+	success = w.deleteNode(x, sn)
+	if success && bs != nil {
+		w.logWAL(walDelete, sn, bs)
+	}
+
+	return
+}
+
+// Caller should have entered the epoch of sn
+func (w *Writer) deleteNode(x *skiplist.Node, sn uint32) (success bool) {
 	defer func() {
 		if success {
-			w.count--
+			w.ep.count--
 		}
 	}()
 
 	x.GClink = nil
-	sn := w.getCurrSn()
 	gotItem := (*Item)(x.Item())
 	if gotItem.bornSn == sn {
-		success = w.store.DeleteNode(x, w.insCmp, w.buf, &w.slSts1)
+		success = w.store.DeleteNode(x, w.insCmp, w.buf, &w.ep.slSts)
+		if success {
+			w.recordChange(feedCancel, gotItem.Bytes())
+		}
 
 		barrier := w.store.GetAccesBarrier()
 		barrier.FlushSession(unsafe.Pointer(x))
@@ -253,17 +394,220 @@ func (w *Writer) DeleteNode(x *skiplist.Node) (success bool) {
 
 	success = atomic.CompareAndSwapUint32(&gotItem.deadSn, 0, sn)
 	if success {
-		if w.gctail == nil {
-			w.gctail = x
-			w.gchead = w.gctail
+		w.addToGCList(x)
+		w.recordChange(feedDelete, gotItem.Bytes())
+	}
+	return
+}
+
+func (w *Writer) addToGCList(x *skiplist.Node) {
+	ep := w.ep
+	if ep.gctail == nil {
+		ep.gctail = x
+		ep.gchead = ep.gctail
+	} else {
+		ep.gctail.GClink = x
+		ep.gctail = x
+	}
+}
+
+// Upsert inserts an item or replaces the existing item with the same key.
+// The old item remains visible to the snapshots created before the upsert.
+// Upsert returns the skiplist node of the replaced item, if any and whether
+// the new item was inserted.
+// The item lookup and the insert is performed using a single path search.
+// The new version is inserted before the old item is marked as deleted.
+// Hence, the key does not disappear for the concurrent writers and the old
+// item is left untouched if the insert fails.
+func (w *Writer) Upsert(bs []byte) (old *skiplist.Node, inserted bool) {
+	iter := w.store.NewIterator(w.iterCmp, w.buf)
+	defer iter.Close()
+
+	sn := w.enterEpoch()
+	defer w.exitEpoch()
+
+	x := w.newItem(bs, w.useMemoryMgmt)
+	x.bornSn = sn
+
+	var oldItem *Item
+	var oldBytes []byte
+	existCmp := w.existCmp
+	level := w.store.NewLevel(w.rand.Float32)
+	skipFindPath := true
+	if found := iter.SeekWithCmp(unsafe.Pointer(x), w.insCmp, w.existCmp); found {
+		old = iter.GetNode()
+		oldItem = (*Item)(old.Item())
+		if oldItem.bornSn == sn {
+			// Both versions cannot coexist as they belong to the same
+			// snapshot. The delete is logged if the insert fails.
+			if w.wal != nil && !w.walOff {
+				oldBytes = append([]byte(nil), oldItem.Bytes()...)
+			}
+
+			if !w.deleteNode(old, sn) {
+				old = nil
+			}
+			oldItem = nil
+			skipFindPath = false
 		} else {
-			w.gctail.GClink = x
-			w.gctail = x
+			// The new version is placed after the old item
+			existCmp = func(this, that unsafe.Pointer) int {
+				if that == unsafe.Pointer(oldItem) {
+					return 1
+				}
+				return w.existCmp(this, that)
+			}
+		}
+	}
+
+	// The action buffer holds the insert path found by the seek
+	_, inserted = w.store.Insert3(unsafe.Pointer(x), w.insCmp, existCmp, w.buf,
+		level, skipFindPath, &w.ep.slSts)
+	if !inserted {
+		w.freeItem(x)
+		if old != nil && oldBytes != nil {
+			w.logWAL(walDelete, sn, oldBytes)
+		}
+
+		if oldItem != nil {
+			old = nil
+		}
+		return
+	}
+
+	w.ep.count++
+	if oldItem != nil {
+		if atomic.CompareAndSwapUint32(&oldItem.deadSn, 0, sn) {
+			old.GClink = nil
+			w.addToGCList(old)
+			w.ep.count--
+			w.recordChange(feedDelete, oldItem.Bytes())
+		} else {
+			// The old item was deleted concurrently
+			old = nil
 		}
 	}
+
+	w.logWAL(walUpsert, sn, bs)
+	w.recordChange(feedInsert, bs)
 	return
 }
 
+type batchSorter struct {
+	items  [][]byte
+	order  []int
+	keyCmp KeyCompare
+}
+
+func (b *batchSorter) Len() int      { return len(b.order) }
+func (b *batchSorter) Swap(i, j int) { b.order[i], b.order[j] = b.order[j], b.order[i] }
+func (b *batchSorter) Less(i, j int) bool {
+	return b.keyCmp(b.items[b.order[i]], b.items[b.order[j]]) < 0
+}
+
+// doBatch sorts the batch items and executes the callback for the items
+// in the ascending key order. The path searches for consecutive items
+// resume from the predecessors of the previous item. Items with the same
+// key are processed in the batch order.
+func (w *Writer) doBatch(bs [][]byte, callb func(int, []byte)) {
+	b := &batchSorter{
+		items:  bs,
+		order:  make([]int, len(bs)),
+		keyCmp: w.keyCmp,
+	}
+
+	for i := range b.order {
+		b.order[i] = i
+	}
+	sort.Stable(b)
+
+	barrier := w.store.GetAccesBarrier()
+	token := barrier.Acquire()
+	defer barrier.Release(token)
+
+	w.buf.UseFinger(true)
+	defer w.buf.UseFinger(false)
+
+	for _, i := range b.order {
+		callb(i, bs[i])
+	}
+}
+
+// PutBatch inserts a batch of items
+// The items are inserted in the key order to reduce the cost of path search.
+// It returns the skiplist nodes for the items in the same order as the
+// batch. The node is nil if the insert failed as done by Put2().
+func (w *Writer) PutBatch(bs [][]byte) []*skiplist.Node {
+	w.beginWALBatch()
+	defer w.endWALBatch()
+
+	nodes := make([]*skiplist.Node, len(bs))
+	w.doBatch(bs, func(i int, itm []byte) {
+		nodes[i] = w.Put2(itm)
+	})
+
+	return nodes
+}
+
+// DeleteBatch deletes a batch of items
+// It returns the status of the deletes in the same order as the batch.
+func (w *Writer) DeleteBatch(bs [][]byte) []bool {
+	w.beginWALBatch()
+	defer w.endWALBatch()
+
+	status := make([]bool, len(bs))
+	w.doBatch(bs, func(i int, itm []byte) {
+		status[i] = w.Delete(itm)
+	})
+
+	return status
+}
+
+// DeleteRange deletes all items in the [start, end) key range
+// A nil start or end denotes an unbounded range on that side.
+// The deleted items are garbage collected once the snapshots which
+// can see them are closed. It returns the number of deleted items.
+func (w *Writer) DeleteRange(start, end []byte) (int, error) {
+	var count int
+
+	if w.hasShutdown {
+		return 0, ErrShutdown
+	}
+
+	if start != nil && end != nil && w.keyCmp(start, end) > 0 {
+		return 0, ErrInvalidRange
+	}
+
+	w.beginWALBatch()
+	defer w.endWALBatch()
+
+	// DeleteNode() uses the writer action buffer
+	buf := w.store.MakeBuf()
+	defer w.store.FreeBuf(buf)
+	iter := w.store.NewIterator(w.iterCmp, buf)
+	defer iter.Close()
+
+	if start == nil {
+		iter.SeekFirst()
+	} else {
+		iter.Seek(unsafe.Pointer(w.newItem(start, false)))
+	}
+
+	for ; iter.Valid(); iter.Next() {
+		x := iter.GetNode()
+		itm := (*Item)(x.Item())
+		if end != nil && w.keyCmp(itm.Bytes(), end) >= 0 {
+			break
+		}
+
+		if atomic.LoadUint32(&itm.deadSn) == 0 && w.DeleteNode(x) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
 // GetNode implements lookup of an item and return its skiplist Node
 // This API enables to lookup an item without using a snapshot handle.
 func (w *Writer) GetNode(bs []byte) *skiplist.Node {
@@ -271,7 +615,8 @@ func (w *Writer) GetNode(bs []byte) *skiplist.Node {
 	defer iter.Close()
 
 	x := w.newItem(bs, false)
-	x.bornSn = w.getCurrSn()
+	x.bornSn = w.enterEpoch()
+	defer w.exitEpoch()
 
 	if found := iter.SeekWithCmp(unsafe.Pointer(x), w.insCmp, w.existCmp); found {
 		return iter.GetNode()
@@ -282,10 +627,11 @@ func (w *Writer) GetNode(bs []byte) *skiplist.Node {
 
 // Config - Nitro instance configuration
 type Config struct {
-	keyCmp   KeyCompare
-	insCmp   skiplist.CompareFn
-	iterCmp  skiplist.CompareFn
-	existCmp skiplist.CompareFn
+	keyCmp     KeyCompare
+	keyCmpName string
+	insCmp     skiplist.CompareFn
+	iterCmp    skiplist.CompareFn
+	existCmp   skiplist.CompareFn
 
 	refreshRate int
 	fileType    FileType
@@ -294,16 +640,42 @@ type Config struct {
 	useDeltaFiles bool
 	mallocFun     skiplist.MallocFn
 	freeFun       skiplist.FreeFn
+
+	walDir          string
+	walSync         WALSyncPolicy
+	walSyncInterval time.Duration
+
+	retainSnapshots int
 }
 
 // SetKeyComparator provides key comparator for the Nitro item data
+// The comparator is not recorded in the backups. Use SetNamedKeyComparator
+// to verify that a backup is restored using the same comparator.
 func (cfg *Config) SetKeyComparator(cmp KeyCompare) {
+	cfg.SetNamedKeyComparator(cmp, "")
+}
+
+// SetNamedKeyComparator is same as SetKeyComparator(). The name is recorded
+// in the backups and a backup written using a different named comparator is
+// rejected on restore. The check is skipped if either comparator is unnamed.
+func (cfg *Config) SetNamedKeyComparator(cmp KeyCompare, name string) {
 	cfg.keyCmp = cmp
+	cfg.keyCmpName = name
 	cfg.insCmp = newInsertCompare(cmp)
 	cfg.iterCmp = newIterCompare(cmp)
 	cfg.existCmp = newExistCompare(cmp)
 }
 
+// SetFileType sets the file format used for disk backups
+func (cfg *Config) SetFileType(t FileType) error {
+	if _, err := lookupFileType(t); err != nil {
+		return err
+	}
+
+	cfg.fileType = t
+	return nil
+}
+
 // UseMemoryMgmt provides custom memory allocator for Nitro items storage
 func (cfg *Config) UseMemoryMgmt(malloc skiplist.MallocFn, free skiplist.FreeFn) {
 	if runtime.GOARCH == "amd64" {
@@ -313,6 +685,21 @@ func (cfg *Config) UseMemoryMgmt(malloc skiplist.MallocFn, free skiplist.FreeFn)
 	}
 }
 
+// UseWAL enables write ahead logging of the writer operations into a directory.
+// The log is replayed by LoadFromDisk and RecoverFromWAL. The sync interval is
+// used only by WALSyncInterval policy.
+func (cfg *Config) UseWAL(dir string, policy WALSyncPolicy, interval time.Duration) {
+	cfg.walDir = dir
+	cfg.walSync = policy
+	cfg.walSyncInterval = interval
+}
+
+// RetainSnapshots keeps the last n snapshots created by NewSnapshot alive so
+// that they can be reopened using OpenSnapshot
+func (cfg *Config) RetainSnapshots(n int) {
+	cfg.retainSnapshots = n
+}
+
 // UseDeltaInterleaving option enables to avoid additional memory required during disk backup
 // as due to locking of older snapshots. This non-intrusive backup mode
 // eliminates the need for locking garbage collectable old snapshots. But, it may
@@ -331,16 +718,36 @@ type Nitro struct {
 	id           int
 	store        *skiplist.Skiplist
 	currSn       uint32
+	snGen        uint32
 	snapshots    *skiplist.Skiplist
 	gcsnapshots  *skiplist.Skiplist
 	isGCRunning  int32
 	lastGCSn     uint32
 	leastUnrefSn uint32
 	itemsCount   int64
+	gcPending    int64
+
+	wlist     *Writer
+	wlistLock sync.Mutex
+	gcchan    chan *skiplist.Node
+	freechan  chan *skiplist.Node
+	wal       *walManager
+	feed      feedState
 
-	wlist    *Writer
-	gcchan   chan *skiplist.Node
-	freechan chan *skiplist.Node
+	// Snapshot numbers of the backups using the delta files of the writers
+	deltaBackups []uint32
+
+	// Serializes NewSnapshot
+	snapLock sync.Mutex
+	// Pauses the writers while the snapshot numbers wrap around
+	wrapping int32
+
+	// The bornSn of the items are not older than agedSn
+	agedSn uint32
+	aging  int32
+
+	retainLock sync.Mutex
+	retained   []*Snapshot
 
 	hasShutdown bool
 	shutdownWg1 sync.WaitGroup // GC workers and StoreToDisk task
@@ -365,6 +772,10 @@ func NewWithConfig(cfg Config) *Nitro {
 	m.store = skiplist.NewWithConfig(m.newStoreConfig())
 	m.initSizeFuns()
 
+	if cfg.walDir != "" {
+		m.wal = newWALManager(cfg.walDir, cfg.walSync, cfg.walSyncInterval)
+	}
+
 	buf := dbInstances.MakeBuf()
 	defer dbInstances.FreeBuf(buf)
 	dbInstances.Insert(unsafe.Pointer(m), CompareNitro, buf, &dbInstances.Stats)
@@ -414,12 +825,18 @@ func (m *Nitro) MemoryInUse() int64 {
 
 // Close shuts down the nitro instance
 func (m *Nitro) Close() {
+	m.releaseRetained(0)
+
 	// Wait until all snapshot iterators have finished
 	for s := m.snapshots.GetStats(); int(s.NodeCount) != 0; s = m.snapshots.GetStats() {
 		time.Sleep(time.Millisecond)
 	}
 
 	m.hasShutdown = true
+	m.closeSubscriptions()
+	if m.wal != nil {
+		m.wal.close()
+	}
 
 	// Acquire gc chan ownership
 	// This will make sure that no other goroutine will write to gcchan
@@ -441,33 +858,54 @@ func (m *Nitro) Close() {
 		m.shutdownWg2.Wait()
 
 		// Manually free up all nodes
-		iter := m.store.NewIterator(m.iterCmp, buf)
-		defer iter.Close()
-		var lastNode *skiplist.Node
+		m.freeNodes(m.store, buf)
+	}
+}
+
+func (m *Nitro) freeNodes(store *skiplist.Skiplist, buf *skiplist.ActionBuffer) {
+	iter := store.NewIterator(m.iterCmp, buf)
+	defer iter.Close()
+	var lastNode *skiplist.Node
+
+	iter.SeekFirst()
+	if iter.Valid() {
+		lastNode = iter.GetNode()
+		iter.Next()
+	}
+
+	for lastNode != nil {
+		m.freeItem((*Item)(lastNode.Item()))
+		store.FreeNode(lastNode, &store.Stats)
+		lastNode = nil
 
-		iter.SeekFirst()
 		if iter.Valid() {
 			lastNode = iter.GetNode()
 			iter.Next()
 		}
+	}
+}
 
-		for lastNode != nil {
-			m.freeItem((*Item)(lastNode.Item()))
-			m.store.FreeNode(lastNode, &m.store.Stats)
-			lastNode = nil
-
-			if iter.Valid() {
-				lastNode = iter.GetNode()
-				iter.Next()
-			}
-		}
+// discardStore frees the items of a partially restored store and resets the
+// Nitro instance to an empty store
+func (m *Nitro) discardStore(store *skiplist.Skiplist) {
+	if m.useMemoryMgmt {
+		buf := store.MakeBuf()
+		m.freeNodes(store, buf)
+		store.FreeBuf(buf)
 	}
+
+	m.store = skiplist.NewWithConfig(m.newStoreConfig())
+	m.store.SetItemSizeFunc(ItemSize)
 }
 
 func (m *Nitro) getCurrSn() uint32 {
 	return atomic.LoadUint32(&m.currSn)
 }
 
+func (m *Nitro) getSnGen() uint32 {
+	return atomic.LoadUint32(&m.snGen)
+}
+
 func (m *Nitro) newWriter() *Writer {
 	w := &Writer{
 		rand:  rand.New(rand.NewSource(int64(rand.Int()))),
@@ -475,18 +913,25 @@ func (m *Nitro) newWriter() *Writer {
 		Nitro: m,
 	}
 
-	w.slSts1.IsLocal(true)
+	w.epochs[0].slSts.IsLocal(true)
+	w.epochs[1].slSts.IsLocal(true)
+	w.ep = &w.epochs[0]
 	w.slSts2.IsLocal(true)
 	w.slSts3.IsLocal(true)
 	return w
 }
 
 // NewWriter creates a Nitro writer
+// A writer which is not needed anymore should be closed.
 func (m *Nitro) NewWriter() *Writer {
 	w := m.newWriter()
+	w.dwrCtx.Init()
+	w.stop = make(chan struct{})
+
+	m.wlistLock.Lock()
 	w.next = m.wlist
 	m.wlist = w
-	w.dwrCtx.Init()
+	m.wlistLock.Unlock()
 
 	m.shutdownWg1.Add(1)
 	go m.collectionWorker(w)
@@ -498,9 +943,54 @@ func (m *Nitro) NewWriter() *Writer {
 	return w
 }
 
+// Close retires the writer and it should not be used after Close.
+// The writer is not removed immediately. The next NewSnapshot hands over its
+// garbage items and stats to the snapshot, removes the writer and stops its
+// workers. Hence, a closed writer is released only once a snapshot is
+// created. The removal is further deferred while a delta backup is running.
+// The last writer of the instance is never removed as its collection worker
+// is required for garbage collection. It is released by Nitro.Close.
+func (w *Writer) Close() {
+	if w.walLog != nil {
+		w.wal.closeLog(w.walLog)
+		w.walLog = nil
+	}
+
+	atomic.StoreInt32(&w.closed, 1)
+}
+
+// removeWriters removes the closed writers whose state has been handed over
+// to a snapshot. The last writer is not removed as the collection workers
+// of the writers are required for garbage collection.
+func (m *Nitro) removeWriters(writers []*Writer) {
+	m.wlistLock.Lock()
+	defer m.wlistLock.Unlock()
+
+	// Delta backup needs the collection workers of the writers
+	if len(m.deltaBackups) > 0 {
+		return
+	}
+
+	for _, w := range writers {
+		if m.wlist == w && w.next == nil {
+			return
+		}
+
+		for p := &m.wlist; *p != nil; p = &(*p).next {
+			if *p == w {
+				*p = w.next
+				close(w.stop)
+				m.store.FreeBuf(w.buf)
+				break
+			}
+		}
+	}
+}
+
 // Snapshot describes Nitro immutable snapshot
 type Snapshot struct {
 	sn       uint32
+	snGen    uint32
 	refCount int32
 	db       *Nitro
 	count    int64
@@ -511,8 +1001,20 @@ type Snapshot struct {
 // SnapshotSize returns the memory used by Nitro snapshot metadata
 func SnapshotSize(p unsafe.Pointer) int {
 	s := (*Snapshot)(p)
-	return int(unsafe.Sizeof(s.sn) + unsafe.Sizeof(s.refCount) + unsafe.Sizeof(s.db) +
-		unsafe.Sizeof(s.count) + unsafe.Sizeof(s.gclist))
+	return int(unsafe.Sizeof(s.sn) + unsafe.Sizeof(s.snGen) + unsafe.Sizeof(s.refCount) +
+		unsafe.Sizeof(s.db) + unsafe.Sizeof(s.count) + unsafe.Sizeof(s.gclist))
+}
+
+// Sn returns the snapshot number. The snapshot number along with SnGen()
+// identifies the snapshot for OpenSnapshot.
+func (s *Snapshot) Sn() uint32 {
+	return s.sn
+}
+
+// SnGen returns the snapshot number generation of the snapshot. The
+// generation is incremented when the snapshot numbers wrap around.
+func (s *Snapshot) SnGen() uint32 {
+	return s.snGen
 }
 
 // Count returns the number of items in the Nitro snapshot
@@ -549,11 +1051,16 @@ func (s *Snapshot) Decode(buf []byte, r io.Reader) error {
 // When snapshots are shared by multiple threads, each thread should Open the
 // snapshot. This API internally tracks the reference count for the snapshot.
 func (s *Snapshot) Open() bool {
-	if atomic.LoadInt32(&s.refCount) == 0 {
-		return false
+	for {
+		refCount := atomic.LoadInt32(&s.refCount)
+		if refCount == 0 {
+			return false
+		}
+
+		if atomic.CompareAndSwapInt32(&s.refCount, refCount, refCount+1) {
+			return true
+		}
 	}
-	atomic.AddInt32(&s.refCount, 1)
-	return true
 }
 
 // Close is the snapshot descructor
@@ -577,88 +1084,280 @@ func (s *Snapshot) NewIterator() *Iterator {
 	return s.db.NewIterator(s)
 }
 
+func (s *Snapshot) isVisible(itm *Item) bool {
+	return isVisibleAt(itm, s.sn)
+}
+
+func isVisibleAt(itm *Item, sn uint32) bool {
+	return (itm.bornSn == 0 || snCompare(itm.bornSn, sn) <= 0) &&
+		(itm.deadSn == 0 || snCompare(itm.deadSn, sn) > 0)
+}
+
+// Get looks up an item by its key in the snapshot and returns the item data.
+// It avoids the overhead of creating an iterator for point lookups.
+// The returned bytes are valid until the snapshot is closed.
+func (s *Snapshot) Get(bs []byte) ([]byte, bool) {
+	m := s.db
+	x, buf := newKeyItem(bs)
+	defer freeKeyItem(buf)
+
+	barrier := m.store.GetAccesBarrier()
+	token := barrier.Acquire()
+	defer barrier.Release(token)
+
+	n := m.store.Lookup(unsafe.Pointer(x), m.iterCmp, func(p unsafe.Pointer) bool {
+		return s.isVisible((*Item)(p))
+	}, &m.store.Stats)
+
+	if n == nil {
+		return nil, false
+	}
+
+	return (*Item)(n.Item()).Bytes(), true
+}
+
 // CompareSnapshot implements comparator for snapshots based on snapshot number
 func CompareSnapshot(this, that unsafe.Pointer) int {
 	thisItem := (*Snapshot)(this)
 	thatItem := (*Snapshot)(that)
 
-	return int(thisItem.sn) - int(thatItem.sn)
+	return snCompare(thisItem.sn, thatItem.sn)
 }
 
 // NewSnapshot creates a new Nitro snapshot.
-// This is a thread-unsafe API.
-// While this API is invoked, no other Nitro writer should concurrently call any
-// public APIs such as Put*() and Delete*().
+// It is safe to call NewSnapshot concurrently with the writers. The writes
+// which have started before the snapshot are included in the snapshot
+// and NewSnapshot waits for them to finish.
+// The changes in the snapshot are delivered to the change feed subscribers.
+// The snapshot numbers wrap around on reaching the 32 bit limit and the
+// snapshot number generation is incremented. NewSnapshot returns
+// ErrMaxSnapshotsLimitReached if a snapshot has been kept open while 2^30
+// newer snapshots were created.
 func (m *Nitro) NewSnapshot() (*Snapshot, error) {
 	buf := m.snapshots.MakeBuf()
 	defer m.snapshots.FreeBuf(buf)
 
+	m.snapLock.Lock()
+	defer m.snapLock.Unlock()
+
+	sn := m.getCurrSn()
+	if sn-atomic.LoadUint32(&m.agedSn) >= snAgeInterval {
+		m.startAgeSn()
+	}
+
+	if sn-atomic.LoadUint32(&m.agedSn) >= snMaxRange {
+		return nil, ErrMaxSnapshotsLimitReached
+	}
+
+	// The writers closed before moving to the next sn do not have any
+	// writes after this snapshot
+	m.wlistLock.Lock()
+	var writers, closed []*Writer
+	for w := m.wlist; w != nil; w = w.next {
+		writers = append(writers, w)
+		if atomic.LoadInt32(&w.closed) == 1 {
+			closed = append(closed, w)
+		}
+	}
+	m.wlistLock.Unlock()
+
+	// New writer operations use the next sn
+	gen := m.getSnGen()
+	if newSn := nextSn(sn); newSn < sn {
+		m.wrapSn(gen+1, newSn)
+	} else {
+		atomic.StoreUint32(&m.currSn, newSn)
+	}
+
 	// Stitch all local gclists from all writers to create snapshot gclist
 	var head, tail *skiplist.Node
+	var events [][]feedEvent
 
-	for w := m.wlist; w != nil; w = w.next {
+	for _, w := range writers {
+		for atomic.LoadUint32(&w.activeSn) == sn {
+			runtime.Gosched()
+		}
+
+		ep := &w.epochs[sn&1]
 		if tail == nil {
-			head = w.gchead
-			tail = w.gctail
-		} else if w.gchead != nil {
-			tail.GClink = w.gchead
-			tail = w.gctail
+			head = ep.gchead
+			tail = ep.gctail
+		} else if ep.gchead != nil {
+			tail.GClink = ep.gchead
+			tail = ep.gctail
 		}
 
-		w.gchead = nil
-		w.gctail = nil
+		ep.gchead = nil
+		ep.gctail = nil
+
+		if len(ep.feedEvents) > 0 {
+			events = append(events, ep.feedEvents)
+			ep.feedEvents = nil
+		}
 
 		// Update global stats
-		m.store.Stats.Merge(&w.slSts1)
-		atomic.AddInt64(&m.itemsCount, w.count)
-		w.count = 0
+		m.store.Stats.Merge(&ep.slSts)
+		atomic.AddInt64(&m.itemsCount, ep.count)
+		ep.count = 0
 	}
 
-	snap := &Snapshot{db: m, sn: m.getCurrSn(), refCount: 1, count: m.ItemsCount()}
-	m.snapshots.Insert(unsafe.Pointer(snap), CompareSnapshot, buf, &m.snapshots.Stats)
+	if len(closed) > 0 {
+		m.removeWriters(closed)
+	}
+
+	snap := &Snapshot{db: m, sn: sn, snGen: gen, refCount: 1, count: m.ItemsCount()}
 	snap.gclist = head
-	newSn := atomic.AddUint32(&m.currSn, 1)
-	if newSn == math.MaxUint32 {
-		return nil, ErrMaxSnapshotsLimitReached
+	m.snapshots.Insert(unsafe.Pointer(snap), CompareSnapshot, buf, &m.snapshots.Stats)
+	m.emitChanges(snap, events)
+	if m.retainSnapshots > 0 {
+		snap.Open()
+		m.retainLock.Lock()
+		m.retained = append(m.retained, snap)
+		m.retainLock.Unlock()
+		m.releaseRetained(m.retainSnapshots)
 	}
 
 	return snap, nil
 }
 
-// ItemsCount returns the number of items in the Nitro instance
-func (m *Nitro) ItemsCount() int64 {
-	return atomic.LoadInt64(&m.itemsCount)
-}
+// wrapSn moves to the next generation of snapshot numbers. The log records
+// of the new generation should follow the records of the previous one.
+// Hence, the writers are paused until currSn is moved.
+// Caller should hold the snapLock.
+func (m *Nitro) wrapSn(gen, sn uint32) {
+	atomic.StoreInt32(&m.wrapping, 1)
+	defer atomic.StoreInt32(&m.wrapping, 0)
 
-func (m *Nitro) collectionWorker(w *Writer) {
-	buf := m.store.MakeBuf()
-	defer m.store.FreeBuf(buf)
-	defer m.shutdownWg1.Done()
+	m.wlistLock.Lock()
+	for w := m.wlist; w != nil; w = w.next {
+		for atomic.LoadUint32(&w.activeSn) != 0 {
+			runtime.Gosched()
+		}
+	}
+	m.wlistLock.Unlock()
 
-	for {
-		select {
-		case <-w.dwrCtx.notifyStatus:
-			w.doCheckpoint()
-		case gclist, ok := <-m.gcchan:
-			if !ok {
-				close(w.dwrCtx.closed)
-				return
-			}
-			for n := gclist; n != nil; n = n.GClink {
-				w.doDeltaWrite((*Item)(n.Item()))
-				m.store.DeleteNode(n, m.insCmp, buf, &w.slSts2)
-			}
+	if m.wal != nil {
+		m.wal.rebase(gen)
+	}
 
-			m.store.Stats.Merge(&w.slSts2)
+	atomic.StoreUint32(&m.snGen, gen)
+	atomic.StoreUint32(&m.currSn, sn)
+}
 
-			barrier := m.store.GetAccesBarrier()
-			barrier.FlushSession(unsafe.Pointer(gclist))
-		}
+// startAgeSn starts the aging of the items born before the oldest snapshot
+// in use. Caller should hold the snapLock.
+func (m *Nitro) startAgeSn() {
+	if m.hasShutdown || !atomic.CompareAndSwapInt32(&m.aging, 0, 1) {
+		return
 	}
-}
+
+	// Acquire gc ownership to read lastGCSn
+	if !atomic.CompareAndSwapInt32(&m.isGCRunning, 0, 1) {
+		atomic.StoreInt32(&m.aging, 0)
+		return
+	}
+	sn := m.lastGCSn
+	atomic.CompareAndSwapInt32(&m.isGCRunning, 1, 0)
+
+	// A delta backup visits the items of its snapshot after closing it
+	m.wlistLock.Lock()
+	for _, dsn := range m.deltaBackups {
+		if snCompare(dsn, sn) < 0 {
+			sn = dsn
+		}
+	}
+	m.wlistLock.Unlock()
+
+	if sn == 0 || snCompare(sn, atomic.LoadUint32(&m.agedSn)) <= 0 {
+		atomic.StoreInt32(&m.aging, 0)
+		return
+	}
+
+	m.shutdownWg1.Add(1)
+	go m.ageSn(sn)
+}
+
+// ageSn moves the bornSn of the items born before sn to sn. All the
+// snapshots in use are not older than sn. Hence, the visibility of the items
+// is not changed and it runs concurrently with the readers and writers.
+// The items deleted before sn are garbage and they are left alone to retain
+// the order of the versions of an item.
+func (m *Nitro) ageSn(sn uint32) {
+	defer m.shutdownWg1.Done()
+	defer atomic.StoreInt32(&m.aging, 0)
+
+	buf := m.store.MakeBuf()
+	defer m.store.FreeBuf(buf)
+	iter := m.store.NewIterator(m.iterCmp, buf)
+	defer iter.Close()
+
+	for iter.SeekFirst(); iter.Valid(); iter.Next() {
+		if m.hasShutdown {
+			return
+		}
+
+		itm := (*Item)(iter.GetNode().Item())
+		bornSn := atomic.LoadUint32(&itm.bornSn)
+		deadSn := atomic.LoadUint32(&itm.deadSn)
+		if bornSn != 0 && snCompare(bornSn, sn) < 0 && (deadSn == 0 || snCompare(deadSn, sn) > 0) {
+			atomic.CompareAndSwapUint32(&itm.bornSn, bornSn, sn)
+		}
+	}
+
+	atomic.StoreUint32(&m.agedSn, sn)
+}
+
+// ItemsCount returns the number of items in the Nitro instance
+func (m *Nitro) ItemsCount() int64 {
+	return atomic.LoadInt64(&m.itemsCount)
+}
+
+func (m *Nitro) collectionWorker(w *Writer) {
+	buf := m.store.MakeBuf()
+	defer m.store.FreeBuf(buf)
+	defer m.shutdownWg1.Done()
+
+	for {
+		select {
+		case <-w.stop:
+			close(w.dwrCtx.closed)
+			return
+		case <-w.dwrCtx.notifyStatus:
+			w.doCheckpoint()
+		case gclist, ok := <-m.gcchan:
+			if !ok {
+				close(w.dwrCtx.closed)
+				return
+			}
+			for n := gclist; n != nil; n = n.GClink {
+				w.doDeltaWrite((*Item)(n.Item()))
+				m.store.DeleteNode(n, m.insCmp, buf, &w.slSts2)
+			}
+
+			m.store.Stats.Merge(&w.slSts2)
+
+			barrier := m.store.GetAccesBarrier()
+			barrier.FlushSession(unsafe.Pointer(gclist))
+			atomic.AddInt64(&m.gcPending, -1)
+		}
+	}
+}
 
 func (m *Nitro) freeWorker(w *Writer) {
-	for freelist := range m.freechan {
+	defer m.shutdownWg2.Done()
+
+	for {
+		var freelist *skiplist.Node
+		select {
+		case <-w.stop:
+			return
+		case fl, ok := <-m.freechan:
+			if !ok {
+				return
+			}
+			freelist = fl
+		}
+
 		for n := freelist; n != nil; {
 			dnode := n
 			n = n.GClink
@@ -670,8 +1369,6 @@ func (m *Nitro) freeWorker(w *Writer) {
 
 		m.store.Stats.Merge(&w.slSts3)
 	}
-
-	m.shutdownWg2.Done()
 }
 
 // Invariant: Each snapshot n is dependent on snapshot n-1.
@@ -688,11 +1385,12 @@ func (m *Nitro) collectDead() {
 	for iter.SeekFirst(); iter.Valid(); iter.Next() {
 		node := iter.GetNode()
 		sn := (*Snapshot)(node.Item())
-		if sn.sn != m.lastGCSn+1 {
+		if sn.sn != nextSn(m.lastGCSn) {
 			return
 		}
 
 		m.lastGCSn = sn.sn
+		atomic.AddInt64(&m.gcPending, 1)
 		m.gcchan <- sn.gclist
 		m.gcsnapshots.DeleteNode(node, CompareSnapshot, buf2, &m.gcsnapshots.Stats)
 	}
@@ -706,6 +1404,43 @@ func (m *Nitro) GC() {
 	}
 }
 
+// releaseRetained closes the older retained snapshots leaving n snapshots
+func (m *Nitro) releaseRetained(n int) {
+	m.retainLock.Lock()
+	var release []*Snapshot
+	if len(m.retained) > n {
+		release = m.retained[:len(m.retained)-n]
+		m.retained = append([]*Snapshot(nil), m.retained[len(m.retained)-n:]...)
+	}
+	m.retainLock.Unlock()
+
+	for _, snap := range release {
+		snap.Close()
+	}
+}
+
+// OpenSnapshot opens a live snapshot by its snapshot number generation and
+// snapshot number. The snapshot should be closed after use.
+// ErrSnapshotNotFound is returned if the snapshot has been collected or the
+// snapshot number belongs to another generation.
+func (m *Nitro) OpenSnapshot(gen, sn uint32) (*Snapshot, error) {
+	buf := m.snapshots.MakeBuf()
+	defer m.snapshots.FreeBuf(buf)
+
+	iter := m.snapshots.NewIterator(CompareSnapshot, buf)
+	defer iter.Close()
+
+	iter.Seek(unsafe.Pointer(&Snapshot{sn: sn}))
+	if iter.Valid() {
+		snap := (*Snapshot)(iter.Get())
+		if snap.sn == sn && snap.snGen == gen && snap.Open() {
+			return snap, nil
+		}
+	}
+
+	return nil, ErrSnapshotNotFound
+}
+
 // GetSnapshots returns the list of current live snapshots
 // This API is mainly for debugging purpose
 func (m *Nitro) GetSnapshots() []*Snapshot {
@@ -731,8 +1466,16 @@ func (m *Nitro) ptrToItem(itmPtr unsafe.Pointer) *Item {
 
 // Visitor implements concurrent Nitro snapshot visitor
 // This API divides the range of keys in a snapshot into `shards` range partitions
+// having similar item bytes.
 // Number of concurrent worker threads used can be specified.
 func (m *Nitro) Visitor(snap *Snapshot, callb VisitorCallback, shards int, concurrency int) error {
+	return m.visitor(snap, callb, shards, concurrency, nil)
+}
+
+// visitor visits the items selected by the filter. The items visible in the
+// snapshot are visited if the filter is nil.
+func (m *Nitro) visitor(snap *Snapshot, callb VisitorCallback, shards int,
+	concurrency int, filter func(*Item) bool) error {
 	var wg sync.WaitGroup
 	var pivotItems []*Item
 
@@ -754,14 +1497,14 @@ func (m *Nitro) Visitor(snap *Snapshot, callb VisitorCallback, shards int, concu
 		defer barrier.Release(token)
 
 		pivotItems = append(pivotItems, nil) // start item
-		pivotPtrs := m.store.GetRangeSplitItems(shards)
+		pivotPtrs := m.store.GetRangeSplitItemsBySize(shards)
 		for _, itmPtr := range pivotPtrs {
 			itm := m.ptrToItem(itmPtr)
 			tmpIter.Seek(itm.Bytes())
 			if tmpIter.Valid() {
 				prevItm := pivotItems[len(pivotItems)-1]
 				// Find bigger item than prev pivot
-				if prevItm == nil || m.insCmp(unsafe.Pointer(itm), unsafe.Pointer(prevItm)) > 0 {
+				if prevItm == nil || m.keyCmp(itm.Bytes(), prevItm.Bytes()) > 0 {
 					pivotItems = append(pivotItems, itm)
 				}
 			}
@@ -778,27 +1521,23 @@ func (m *Nitro) Visitor(snap *Snapshot, callb VisitorCallback, shards int, concu
 			defer wg.Done()
 
 			for shard := range wch {
-				startItem := pivotItems[shard]
-				endItem := pivotItems[shard+1]
+				var start, end []byte
+				if startItem := pivotItems[shard]; startItem != nil {
+					start = startItem.Bytes()
+				}
+				if endItem := pivotItems[shard+1]; endItem != nil {
+					end = endItem.Bytes()
+				}
 
-				itr := m.NewIterator(snap)
+				itr := m.NewRangeIterator(snap, start, end, false)
 				if itr == nil {
 					panic("iterator cannot be nil")
 				}
 				defer itr.Close()
 
+				itr.filter = filter
 				itr.SetRefreshRate(m.refreshRate)
-				if startItem == nil {
-					itr.SeekFirst()
-				} else {
-					itr.Seek(startItem.Bytes())
-				}
-			loop:
-				for ; itr.Valid(); itr.Next() {
-					if endItem != nil && m.insCmp(itr.GetNode().Item(), unsafe.Pointer(endItem)) >= 0 {
-						break loop
-					}
-
+				for itr.SeekFirst(); itr.Valid(); itr.Next() {
 					itm := (*Item)(itr.GetNode().Item())
 					if err := callb(itm, shard); err != nil {
 						errors[shard] = err
@@ -827,6 +1566,9 @@ func (m *Nitro) Visitor(snap *Snapshot, callb VisitorCallback, shards int, concu
 }
 
 func (m *Nitro) numWriters() int {
+	m.wlistLock.Lock()
+	defer m.wlistLock.Unlock()
+
 	var count int
 	for w := m.wlist; w != nil; w = w.next {
 		count++
@@ -835,12 +1577,39 @@ func (m *Nitro) numWriters() int {
 	return count
 }
 
-func (m *Nitro) changeDeltaWrState(state int,
+// beginDeltaBackup returns the writers whose collection workers write the
+// delta files. The writers are not removed until the backup has finished.
+func (m *Nitro) beginDeltaBackup(sn uint32) []*Writer {
+	m.wlistLock.Lock()
+	defer m.wlistLock.Unlock()
+
+	var writers []*Writer
+	for w := m.wlist; w != nil; w = w.next {
+		writers = append(writers, w)
+	}
+
+	m.deltaBackups = append(m.deltaBackups, sn)
+	return writers
+}
+
+func (m *Nitro) endDeltaBackup(sn uint32) {
+	m.wlistLock.Lock()
+	defer m.wlistLock.Unlock()
+
+	for i, dsn := range m.deltaBackups {
+		if dsn == sn {
+			m.deltaBackups = append(m.deltaBackups[:i], m.deltaBackups[i+1:]...)
+			break
+		}
+	}
+}
+
+func (m *Nitro) changeDeltaWrState(state int, dwriters []*Writer,
 	writers []FileWriter, snap *Snapshot) error {
 
 	var err error
 
-	for id, w := 0, m.wlist; w != nil; w, id = w.next, id+1 {
+	for id, w := range dwriters {
 		w.dwrCtx.state = state
 		if state == dwStateInit {
 			w.dwrCtx.sn = snap.sn
@@ -872,7 +1641,48 @@ func (m *Nitro) changeDeltaWrState(state int,
 
 // StoreToDisk backups Nitro snapshot to disk
 // Concurrent threads are used to perform backup and concurrency can be specified.
-func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback ItemCallback) (err error) {
+// The backup is written to a temporary directory and it replaces the
+// directory only after all the files have been written successfully.
+func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback ItemCallback) error {
+	return m.StoreToDiskContext(context.Background(), dir, snap, concurr, itmCallback)
+}
+
+// StoreToDiskContext is same as StoreToDisk(). The backup is aborted when
+// the context is cancelled and ctx.Err() is returned. The partially
+// written files are removed and an existing backup in the directory is
+// retained.
+func (m *Nitro) StoreToDiskContext(ctx context.Context, dir string, snap *Snapshot,
+	concurr int, itmCallback ItemCallback) error {
+	return m.StoreToDiskWithOptions(ctx, dir, snap, concurr, itmCallback, BackupOptions{})
+}
+
+// StoreToDiskWithOptions is same as StoreToDiskContext(). The options
+// specify progress reporting and throttling of the backup.
+func (m *Nitro) StoreToDiskWithOptions(ctx context.Context, dir string, snap *Snapshot,
+	concurr int, itmCallback ItemCallback, opts BackupOptions) error {
+	tmpdir, err := newBackupDir(dir)
+	if err != nil {
+		snap.Close()
+		return err
+	}
+
+	shards := opts.Shards
+	if shards <= 0 {
+		shards = runtime.NumCPU()
+	}
+
+	tr := newBackupTracker(ctx, opts, m.ItemsCount())
+	sums := newFileChecksums()
+	man, err := m.storeToDisk(ctx, tmpdir, snap, shards, concurr, itmCallback, tr, sums)
+	if err = commitBackup(tmpdir, dir, man, sums, err); err == nil && m.wal != nil {
+		err = m.wal.truncate(man.SnGen, man.Sn)
+	}
+
+	return err
+}
+
+func (m *Nitro) storeToDisk(ctx context.Context, dir string, snap *Snapshot, shards, concurr int,
+	itmCallback ItemCallback, tr *backupTracker, sums *fileChecksums) (man *backupManifest, err error) {
 
 	var snapClosed bool
 	defer func() {
@@ -888,57 +1698,71 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 
 	datadir := filepath.Join(dir, "data")
 	os.MkdirAll(datadir, 0755)
-	shards := runtime.NumCPU()
 
 	writers := make([]FileWriter, shards)
 	files := make([]string, shards)
 	defer func() {
 		for _, w := range writers {
 			if w != nil {
-				w.Close()
+				if e := closeFileWriter(w, sums); e != nil && err == nil {
+					err = e
+				}
 			}
 		}
 	}()
 
 	for shard := 0; shard < shards; shard++ {
-		w := m.newFileWriter(m.fileType)
+		w, err := m.NewFileWriter(m.fileType)
+		if err != nil {
+			return nil, err
+		}
+
 		file := fmt.Sprintf("shard-%d", shard)
 		datafile := filepath.Join(datadir, file)
 		if err := w.Open(datafile); err != nil {
-			return err
+			return nil, err
 		}
 
-		writers[shard] = w
+		writers[shard] = tr.wrapWriter(shard, w)
 		files[shard] = file
 	}
 
 	// Initialize and setup delta processing
 	if m.useDeltaFiles {
-		deltaWriters := make([]FileWriter, m.numWriters())
-		deltaFiles := make([]string, m.numWriters())
+		dwriters := m.beginDeltaBackup(snap.sn)
+		defer m.endDeltaBackup(snap.sn)
+
+		deltaWriters := make([]FileWriter, len(dwriters))
+		deltaFiles := make([]string, len(dwriters))
 		defer func() {
 			for _, w := range deltaWriters {
 				if w != nil {
-					w.Close()
+					if e := closeFileWriter(w, sums); e != nil && err == nil {
+						err = e
+					}
 				}
 			}
 		}()
 
 		deltadir := filepath.Join(dir, "delta")
 		os.MkdirAll(deltadir, 0755)
-		for id := 0; id < m.numWriters(); id++ {
-			dw := m.newFileWriter(m.fileType)
+		for id := range dwriters {
+			dw, err := m.NewFileWriter(m.fileType)
+			if err != nil {
+				return nil, err
+			}
+
 			file := fmt.Sprintf("shard-%d", id)
 			deltafile := filepath.Join(deltadir, file)
 			if err = dw.Open(deltafile); err != nil {
-				return err
+				return nil, err
 			}
 			deltaWriters[id] = dw
 			deltaFiles[id] = file
 		}
 
-		if err = m.changeDeltaWrState(dwStateInit, deltaWriters, snap); err != nil {
-			return err
+		if err = m.changeDeltaWrState(dwStateInit, dwriters, deltaWriters, snap); err != nil {
+			return nil, err
 		}
 
 		// Create a placeholder snapshot object. We are decoupled from holding snapshot items
@@ -952,22 +1776,35 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 		snap = &fakeSnap
 
 		defer func() {
-			if err = m.changeDeltaWrState(dwStateTerminate, nil, nil); err == nil {
+			e := m.changeDeltaWrState(dwStateTerminate, dwriters, nil, nil)
+			if e == nil {
 				bs, _ := json.Marshal(deltaFiles)
-				err = ioutil.WriteFile(filepath.Join(deltadir, "files.json"), bs, 0660)
+				e = ioutil.WriteFile(filepath.Join(deltadir, "files.json"), bs, 0660)
+			}
+
+			if err == nil {
+				err = e
 			}
 		}()
 	}
 
+	var count int64
 	visitorCallback := func(itm *Item, shard int) error {
 		if m.hasShutdown {
 			return ErrShutdown
 		}
 
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
 		w := writers[shard]
 		if err := w.WriteItem(itm); err != nil {
 			return err
 		}
+		atomic.AddInt64(&count, 1)
 
 		if itmCallback != nil {
 			itmCallback(&ItemEntry{itm: itm, n: nil})
@@ -976,41 +1813,75 @@ func (m *Nitro) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 		return nil
 	}
 
-	if err = m.Visitor(snap, visitorCallback, shards, concurr); err == nil {
-		bs, _ := json.Marshal(files)
-		err = ioutil.WriteFile(filepath.Join(datadir, "files.json"), bs, 0660)
+	if err = m.Visitor(snap, visitorCallback, shards, concurr); err != nil {
+		return nil, err
 	}
+	tr.finish()
 
-	return err
+	bs, _ := json.Marshal(files)
+	if err = ioutil.WriteFile(filepath.Join(datadir, "files.json"), bs, 0660); err != nil {
+		return nil, err
+	}
+
+	man = &backupManifest{
+		Sn:         snap.sn,
+		SnGen:      snap.snGen,
+		ItemsCount: count,
+		FileType:   m.fileType.String(),
+		Files:      files,
+	}
+
+	return man, nil
 }
 
-// LoadFromDisk restores Nitro from a disk backup
-func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snapshot, error) {
-	var wg sync.WaitGroup
+// restoreSn resumes the snapshot numbers from the backed up snapshot
+func (m *Nitro) restoreSn(gen, sn uint32) {
+	m.snGen = gen
+	if sn > 0 {
+		m.currSn = sn
+		m.lastGCSn = sn - 1
+		m.agedSn = m.lastGCSn
+	}
+}
+
+func readFileList(dir string) ([]string, error) {
 	var files []string
-	var bs []byte
-	var err error
-	datadir := filepath.Join(dir, "data")
+	bs, err := ioutil.ReadFile(filepath.Join(dir, "files.json"))
+	if err != nil {
+		return nil, err
+	}
 
-	if bs, err = ioutil.ReadFile(filepath.Join(datadir, "files.json")); err != nil {
+	if err := json.Unmarshal(bs, &files); err != nil {
 		return nil, err
 	}
-	json.Unmarshal(bs, &files)
 
-	var nodeCallb skiplist.NodeCallback
-	wchan := make(chan int)
-	b := skiplist.NewBuilderWithConfig(m.newStoreConfig())
-	b.SetItemSizeFunc(ItemSize)
-	segments := make([]*skiplist.Segment, len(files))
-	readers := make([]FileReader, len(files))
-	errors := make([]error, len(files))
+	return files, nil
+}
 
-	if callb != nil {
-		nodeCallb = func(n *skiplist.Node) {
-			callb(&ItemEntry{itm: (*Item)(n.Item()), n: n})
-		}
+// readFiles reads the backup files concurrently. The files are divided into
+// at most concurr groups of adjacent files and the files of a group are read
+// in order by a worker. Hence, the number of files need not match the
+// concurrency. The callback is invoked with the worker id and the group
+// index for each item. The readers stop on the first error or when the
+// context is cancelled.
+func (m *Nitro) readFiles(ctx context.Context, dir string, files []string, t FileType,
+	concurr int, tr *backupTracker, callb func(id, group int, itm *Item) error) (err error) {
+	var wg sync.WaitGroup
+	var once sync.Once
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	setError := func(e error) {
+		once.Do(func() {
+			err = e
+			cancel()
+		})
 	}
 
+	wchan := make(chan int)
+	readers := make([]FileReader, len(files))
+
 	defer func() {
 		for _, r := range readers {
 			if r != nil {
@@ -1020,53 +1891,183 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 	}()
 
 	for i, file := range files {
-		segments[i] = b.NewSegment()
-		segments[i].SetNodeCallback(nodeCallb)
-		r := m.newFileReader(m.fileType)
-		datafile := filepath.Join(datadir, file)
-		if err := r.Open(datafile); err != nil {
-			return nil, err
+		r, err := m.NewFileReader(t)
+		if err != nil {
+			return err
 		}
 
-		readers[i] = r
+		if err := r.Open(filepath.Join(dir, file)); err != nil {
+			return err
+		}
+
+		readers[i] = tr.wrapReader(i, r)
+	}
+
+	groups := numFileGroups(len(files), concurr)
+	groupStart := func(group int) int {
+		return group * len(files) / groups
 	}
 
 	for i := 0; i < concurr; i++ {
 		wg.Add(1)
-		go func(wg *sync.WaitGroup) {
+		go func(wg *sync.WaitGroup, id int) {
 			defer wg.Done()
 
-			for shard := range wchan {
-				r := readers[shard]
+			for group := range wchan {
 			loop:
-				for {
-					itm, err := r.ReadItem()
-					if err != nil {
-						errors[shard] = err
-						return
-					}
+				for _, r := range readers[groupStart(group):groupStart(group+1)] {
+					for {
+						select {
+						case <-ctx.Done():
+							setError(ctx.Err())
+							break loop
+						default:
+						}
 
-					if itm == nil {
-						break loop
+						itm, err := r.ReadItem()
+						if err != nil {
+							setError(err)
+							break loop
+						}
+
+						if itm == nil {
+							break
+						}
+
+						if err := callb(id, group, itm); err != nil {
+							setError(err)
+							break loop
+						}
 					}
-					segments[shard].Add(unsafe.Pointer(itm))
 				}
 			}
-		}(&wg)
+		}(&wg, i)
 	}
 
-	for i := range files {
+	for i := 0; i < groups; i++ {
 		wchan <- i
 	}
 	close(wchan)
 	wg.Wait()
 
-	for _, err := range errors {
-		if err != nil {
+	return err
+}
+
+// numFileGroups returns the number of groups of adjacent backup files read
+// by readFiles
+func numFileGroups(files, concurr int) int {
+	if concurr < 1 {
+		concurr = 1
+	}
+
+	if files < concurr {
+		return files
+	}
+
+	return concurr
+}
+
+// LoadFromDisk restores Nitro from a disk backup
+// The files are verified using the block checksums while they are read.
+// A backup directory without a manifest is rejected with ErrInvalidBackup.
+// Backups written by older versions can be upgraded using UpgradeBackup.
+// The snapshot numbers are resumed from the backed up snapshot.
+// If write ahead logging is enabled, the log records newer than the
+// backup are replayed.
+func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snapshot, error) {
+	return m.LoadFromDiskContext(context.Background(), dir, concurr, callb)
+}
+
+// LoadFromDiskContext is same as LoadFromDisk(). The restore is aborted when
+// the context is cancelled and ctx.Err() is returned. The partially
+// restored items are freed and the Nitro instance is left empty.
+func (m *Nitro) LoadFromDiskContext(ctx context.Context, dir string, concurr int,
+	callb ItemCallback) (*Snapshot, error) {
+	return m.LoadFromDiskWithOptions(ctx, dir, concurr, callb, BackupOptions{})
+}
+
+// LoadFromDiskWithOptions is same as LoadFromDiskContext(). The options
+// specify progress reporting, throttling and checksum verification of the
+// restore.
+func (m *Nitro) LoadFromDiskWithOptions(ctx context.Context, dir string, concurr int,
+	callb ItemCallback, opts BackupOptions) (*Snapshot, error) {
+	man, err := m.loadFromDisk(ctx, dir, concurr, callb, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.finishRestore(man.SnGen, man.Sn)
+}
+
+func (m *Nitro) finishRestore(gen, sn uint32) (*Snapshot, error) {
+	stats := m.store.GetStats()
+	m.itemsCount = int64(stats.NodeCount)
+	m.restoreSn(gen, sn)
+
+	if m.wal != nil {
+		if err := m.replayWAL(gen, sn); err != nil {
+			return nil, err
+		}
+	}
+
+	return m.NewSnapshot()
+}
+
+func (m *Nitro) loadFromDisk(ctx context.Context, dir string, concurr int,
+	callb ItemCallback, opts BackupOptions) (*backupManifest, error) {
+	var nodeCallb skiplist.NodeCallback
+	datadir := filepath.Join(dir, "data")
+
+	man, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if man.BaseSn != 0 {
+		return nil, ErrIncrementalBackup
+	}
+
+	if opts.VerifyChecksums {
+		if err := verifyFileChecksums(dir, man); err != nil {
 			return nil, err
 		}
 	}
 
+	t, err := lookupFileTypeByName(man.FileType)
+	if err != nil {
+		return nil, err
+	}
+
+	files := man.Files
+
+	// The shard files are range partitions in the key order. The adjacent
+	// files read by a worker are added to the same segment.
+	b := skiplist.NewBuilderWithConfig(m.newStoreConfig())
+	b.SetItemSizeFunc(ItemSize)
+	segments := make([]*skiplist.Segment, numFileGroups(len(files), concurr))
+
+	if callb != nil {
+		nodeCallb = func(n *skiplist.Node) {
+			callb(&ItemEntry{itm: (*Item)(n.Item()), n: n})
+		}
+	}
+
+	for i := range segments {
+		segments[i] = b.NewSegment()
+		segments[i].SetNodeCallback(nodeCallb)
+	}
+
+	tr := newBackupTracker(ctx, opts, man.ItemsCount)
+	err = m.readFiles(ctx, datadir, files, t, concurr, tr, func(_, group int, itm *Item) error {
+		segments[group].Add(unsafe.Pointer(itm))
+		return nil
+	})
+
+	if err != nil {
+		m.discardStore(b.Assemble(segments...))
+		return nil, err
+	}
+
 	m.store = b.Assemble(segments...)
 
 	// Delta processing
@@ -1074,94 +2075,314 @@ func (m *Nitro) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 		m.DeltaRestoreFailed = 0
 		m.DeltaRestored = 0
 
-		wchan := make(chan int)
 		deltadir := filepath.Join(dir, "delta")
-		var files []string
-		if bs, err := ioutil.ReadFile(filepath.Join(deltadir, "files.json")); err == nil {
-			json.Unmarshal(bs, &files)
+		files, _ := readFileList(deltadir)
+		writers := make([]*Writer, concurr)
+		for i := range writers {
+			writers[i] = m.newWriter()
 		}
 
-		readers := make([]FileReader, len(files))
-		errors := make([]error, len(files))
-		writers := make([]*Writer, concurr)
+		err := m.readFiles(ctx, deltadir, files, t, concurr, nil, func(id, _ int, itm *Item) error {
+			w := writers[id]
+			if n, success := w.store.Insert2(unsafe.Pointer(itm),
+				w.insCmp, w.existCmp, w.buf, w.rand.Float32, &w.ep.slSts); success {
 
-		defer func() {
-			for _, r := range readers {
-				if r != nil {
-					r.Close()
+				w.resSts.DeltaRestored++
+				if nodeCallb != nil {
+					nodeCallb(n)
 				}
+			} else {
+				w.freeItem(itm)
+				w.resSts.DeltaRestoreFailed++
 			}
-		}()
 
-		for i, file := range files {
-			r := m.newFileReader(m.fileType)
-			deltafile := filepath.Join(deltadir, file)
-			if err := r.Open(deltafile); err != nil {
-				return nil, err
-			}
+			return nil
+		})
 
-			readers[i] = r
+		// Aggregate stats
+		for _, w := range writers {
+			m.store.Stats.Merge(&w.ep.slSts)
+			atomic.AddUint64(&m.restoreStats.DeltaRestored, w.resSts.DeltaRestored)
+			atomic.AddUint64(&m.restoreStats.DeltaRestoreFailed, w.resSts.DeltaRestoreFailed)
 		}
 
-		for i := 0; i < concurr; i++ {
-			writers[i] = m.newWriter()
-			wg.Add(1)
-			go func(wg *sync.WaitGroup, id int) {
-				defer wg.Done()
+		if err != nil {
+			m.discardStore(m.store)
+			return nil, err
+		}
+	}
 
-				for shard := range wchan {
-					r := readers[shard]
-				loop:
-					for {
-						itm, err := r.ReadItem()
-						if err != nil {
-							errors[shard] = err
-							return
-						}
+	return man, nil
+}
 
-						if itm == nil {
-							break loop
-						}
+// pinSnapshot opens the latest live snapshot with sn <= given sn. The items
+// deleted after the pinned snapshot are not garbage collected until it is
+// closed.
+func (m *Nitro) pinSnapshot(sn uint32) *Snapshot {
+	var pinned *Snapshot
+	for _, s := range m.GetSnapshots() {
+		if snCompare(s.sn, sn) <= 0 && s.Open() {
+			if pinned != nil {
+				pinned.Close()
+			}
+			pinned = s
+		}
+	}
 
-						w := writers[id]
-						if n, success := w.store.Insert2(unsafe.Pointer(itm),
-							w.insCmp, w.existCmp, w.buf, w.rand.Float32, &w.slSts1); success {
-
-							w.resSts.DeltaRestored++
-							if nodeCallb != nil {
-								nodeCallb(n)
-							}
-						} else {
-							w.freeItem(itm)
-							w.resSts.DeltaRestoreFailed++
-						}
+	return pinned
+}
+
+// StoreIncrementalToDisk backups the changes in a Nitro snapshot since an older
+// snapshot (baseSn) to disk. The items added after the base snapshot are written
+// to data files and the items removed after the base snapshot are written to
+// tombstone files. The base snapshot (or an older one) should be kept open
+// until the backup is started so that the removed items are still available.
+// The base snapshot should belong to the same snapshot number generation.
+func (m *Nitro) StoreIncrementalToDisk(dir string, baseSn uint32, snap *Snapshot,
+	concurr int, itmCallback ItemCallback) error {
+	return m.StoreIncrementalToDiskWithOptions(context.Background(), dir, baseSn, snap,
+		concurr, itmCallback, BackupOptions{})
+}
+
+// StoreIncrementalToDiskWithOptions is same as StoreIncrementalToDisk(). The
+// backup is aborted when the context is cancelled. The options specify the
+// number of shards, progress reporting and throttling as for
+// StoreToDiskWithOptions. The estimated items are not known and hence zero.
+func (m *Nitro) StoreIncrementalToDiskWithOptions(ctx context.Context, dir string, baseSn uint32,
+	snap *Snapshot, concurr int, itmCallback ItemCallback, opts BackupOptions) error {
+
+	defer snap.Close()
+
+	// A base number greater than sn belongs to the previous generation
+	if baseSn >= snap.sn {
+		return ErrInvalidIncrementalBase
+	}
+
+	base := m.pinSnapshot(baseSn)
+	if base == nil {
+		return ErrInvalidIncrementalBase
+	}
+	defer base.Close()
+
+	tmpdir, err := newBackupDir(dir)
+	if err != nil {
+		return err
+	}
+
+	shards := opts.Shards
+	if shards <= 0 {
+		shards = runtime.NumCPU()
+	}
+
+	tr := newBackupTracker(ctx, opts, 0)
+	sums := newFileChecksums()
+	man, err := m.storeIncrementalToDisk(ctx, tmpdir, baseSn, snap, shards, concurr, itmCallback, tr, sums)
+	if err = commitBackup(tmpdir, dir, man, sums, err); err == nil && m.wal != nil {
+		err = m.wal.truncate(man.SnGen, man.Sn)
+	}
+
+	return err
+}
+
+func (m *Nitro) storeIncrementalToDisk(ctx context.Context, dir string, baseSn uint32, snap *Snapshot,
+	shards, concurr int, itmCallback ItemCallback, tr *backupTracker,
+	sums *fileChecksums) (man *backupManifest, err error) {
+
+	if m.useMemoryMgmt {
+		m.shutdownWg1.Add(1)
+		defer m.shutdownWg1.Done()
+	}
+
+	writers := make([][]FileWriter, 2)
+	files := make([]string, shards)
+	dirs := []string{filepath.Join(dir, "data"), filepath.Join(dir, "tombstones")}
+	defer func() {
+		for _, ws := range writers {
+			for _, w := range ws {
+				if w != nil {
+					if e := closeFileWriter(w, sums); e != nil && err == nil {
+						err = e
 					}
 				}
-
-				// Aggregate stats
-				w := writers[id]
-				m.store.Stats.Merge(&w.slSts1)
-				atomic.AddUint64(&m.restoreStats.DeltaRestored, w.resSts.DeltaRestored)
-				atomic.AddUint64(&m.restoreStats.DeltaRestoreFailed, w.resSts.DeltaRestoreFailed)
-			}(&wg, i)
+			}
 		}
+	}()
 
-		for i := range files {
-			wchan <- i
-		}
-		close(wchan)
-		wg.Wait()
+	// The progress of a shard covers its data and tombstone files
+	progress := make([]*shardProgress, shards)
+	for shard := range progress {
+		progress[shard] = tr.newShard(shard)
+	}
 
-		for _, err := range errors {
+	var count int64
+	for i, d := range dirs {
+		os.MkdirAll(d, 0755)
+		writers[i] = make([]FileWriter, shards)
+		for shard := 0; shard < shards; shard++ {
+			w, err := m.NewFileWriter(m.fileType)
 			if err != nil {
 				return nil, err
 			}
+
+			files[shard] = fmt.Sprintf("shard-%d", shard)
+			if err := w.Open(filepath.Join(d, files[shard])); err != nil {
+				return nil, err
+			}
+
+			writers[i][shard] = w
 		}
 	}
 
-	stats := m.store.GetStats()
-	m.itemsCount = int64(stats.NodeCount)
-	return m.NewSnapshot()
+	visitorCallback := func(itm *Item, shard int) error {
+		if m.hasShutdown {
+			return ErrShutdown
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		w := writers[1][shard]
+		if snap.isVisible(itm) {
+			w = writers[0][shard]
+		}
+
+		if err := w.WriteItem(itm); err != nil {
+			return err
+		}
+		atomic.AddInt64(&count, 1)
+		if p := progress[shard]; p != nil {
+			p.add(itm)
+		}
+
+		if itmCallback != nil {
+			itmCallback(&ItemEntry{itm: itm, n: nil})
+		}
+
+		return nil
+	}
+
+	if err = m.visitor(snap, visitorCallback, shards, concurr, changedSince(baseSn, snap)); err != nil {
+		return nil, err
+	}
+	tr.finish()
+
+	bs, _ := json.Marshal(files)
+	for _, d := range dirs {
+		if err = ioutil.WriteFile(filepath.Join(d, "files.json"), bs, 0660); err != nil {
+			return nil, err
+		}
+	}
+
+	man = &backupManifest{
+		Sn:         snap.sn,
+		SnGen:      snap.snGen,
+		BaseSn:     baseSn,
+		ItemsCount: count,
+		FileType:   m.fileType.String(),
+		Files:      files,
+	}
+
+	return man, nil
+}
+
+// LoadIncrementalFromDisk restores Nitro from a chain of disk backups. The
+// first directory should be a full backup followed by the incremental backups
+// in the order in which they were taken.
+func (m *Nitro) LoadIncrementalFromDisk(dirs []string, concurr int, callb ItemCallback) (*Snapshot, error) {
+	if len(dirs) == 0 {
+		return nil, ErrInvalidIncrementalBase
+	}
+
+	prev, err := m.loadFromDisk(context.Background(), dirs[0], concurr, callb, BackupOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range dirs[1:] {
+		man, err := readManifest(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		if man.BaseSn == 0 || man.BaseSn != prev.Sn || man.SnGen != prev.SnGen {
+			return nil, ErrInvalidIncrementalBase
+		}
+
+		if err := m.applyIncremental(dir, man, concurr, callb); err != nil {
+			return nil, err
+		}
+		prev = man
+	}
+
+	return m.finishRestore(prev.SnGen, prev.Sn)
+}
+
+// applyIncremental removes the items in the tombstone files from the store and
+// then inserts the items in the data files.
+func (m *Nitro) applyIncremental(dir string, man *backupManifest, concurr int, callb ItemCallback) error {
+	t, err := lookupFileTypeByName(man.FileType)
+	if err != nil {
+		return err
+	}
+
+	writers := make([]*Writer, concurr)
+	for i := range writers {
+		writers[i] = m.newWriter()
+	}
+
+	defer func() {
+		for _, w := range writers {
+			m.store.Stats.Merge(&w.ep.slSts)
+		}
+	}()
+
+	tombdir := filepath.Join(dir, "tombstones")
+	err = m.readFiles(context.Background(), tombdir, man.Files, t, concurr, nil, func(id, _ int, itm *Item) error {
+		defer m.freeItem(itm)
+
+		w := writers[id]
+		barrier := m.store.GetAccesBarrier()
+		token := barrier.Acquire()
+		n := m.store.Lookup(unsafe.Pointer(itm), m.iterCmp, nil, &w.ep.slSts)
+		barrier.Release(token)
+
+		if n != nil && m.store.DeleteNode(n, m.insCmp, w.buf, &w.ep.slSts) {
+			w.addToGCList(n)
+		}
+
+		return nil
+	})
+
+	// No snapshots exist during restore. Hence, the removed items can be
+	// freed once the concurrent readers of the store have moved on.
+	for _, w := range writers {
+		if ep := w.ep; ep.gchead != nil {
+			m.store.GetAccesBarrier().FlushSession(unsafe.Pointer(ep.gchead))
+			ep.gchead, ep.gctail = nil, nil
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	datadir := filepath.Join(dir, "data")
+	return m.readFiles(context.Background(), datadir, man.Files, t, concurr, nil, func(id, _ int, itm *Item) error {
+		w := writers[id]
+		if n, success := w.store.Insert2(unsafe.Pointer(itm),
+			w.insCmp, w.existCmp, w.buf, w.rand.Float32, &w.ep.slSts); success {
+			if callb != nil {
+				callb(&ItemEntry{itm: itm, n: n})
+			}
+		} else {
+			w.freeItem(itm)
+		}
+
+		return nil
+	})
 }
 
 // DumpStats returns Nitro statistics
@@ -1170,9 +2391,13 @@ func (m *Nitro) DumpStats() string {
 }
 
 func (m *Nitro) aggrStoreStats() skiplist.StatsReport {
+	m.wlistLock.Lock()
+	defer m.wlistLock.Unlock()
+
 	sts := m.store.GetStats()
 	for w := m.wlist; w != nil; w = w.next {
-		sts.Apply(&w.slSts1)
+		sts.Apply(&w.epochs[0].slSts)
+		sts.Apply(&w.epochs[1].slSts)
 		sts.Apply(&w.slSts2)
 		sts.Apply(&w.slSts3)
 	}
@@ -10,14 +10,21 @@
 package nitro
 
 import "fmt"
+import "bytes"
+import "context"
 import "sync/atomic"
 import "os"
+import "io/ioutil"
+import "path/filepath"
 import "testing"
 import "time"
+import "math"
 import "math/rand"
 import "sync"
 import "runtime"
 import "encoding/binary"
+import "encoding/json"
+import "hash/crc32"
 import "github.com/t3rm1n4l/nitro/mm"
 
 var testConf Config
@@ -735,3 +742,2046 @@ func TestCloseWithActiveIterators(t *testing.T) {
 	wg.Wait()
 
 }
+
+func TestSnapshotGet(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	for i := 0; i < 1000; i += 2 {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	for i := 0; i < 500; i += 4 {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("%010d", i))
+		if bs, ok := snap1.Get(key); !ok || string(bs) != string(key) {
+			t.Errorf("snap1: expected to find %s", key)
+		}
+
+		exp := i%2 == 1 || (i < 500 && i%4 == 0)
+		if bs, ok := snap2.Get(key); ok != exp || (ok && string(bs) != string(key)) {
+			t.Errorf("snap2: lookup of %s returned %v, expected %v", key, ok, exp)
+		}
+	}
+
+	if _, ok := snap2.Get([]byte("missing")); ok {
+		t.Errorf("Expected lookup of missing key to fail")
+	}
+}
+
+func TestSnapshotGetAllocs(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	key := []byte(fmt.Sprintf("%010d", 500))
+	allocs := testing.AllocsPerRun(100, func() {
+		snap.Get(key)
+	})
+
+	if allocs > 0 {
+		t.Errorf("Expected no allocations per lookup, got %v", allocs)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	conf := testConf
+	conf.SetKeyComparator(CompareKV)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put(KVToBytes([]byte(fmt.Sprintf("%010d", i)), []byte("v1")))
+	}
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	for i := 0; i < 2000; i++ {
+		old, inserted := w.Upsert(KVToBytes([]byte(fmt.Sprintf("%010d", i)), []byte("v2")))
+		if !inserted {
+			t.Errorf("Expected upsert to succeed for %d", i)
+		}
+		if (old != nil) != (i < 1000) {
+			t.Errorf("Unexpected old node for %d", i)
+		}
+	}
+
+	// Replace an item inserted in the same snapshot
+	for i := 1000; i < 1500; i++ {
+		if old, inserted := w.Upsert(KVToBytes([]byte(fmt.Sprintf("%010d", i)), []byte("v3"))); old == nil || !inserted {
+			t.Errorf("Expected upsert to replace item %d", i)
+		}
+	}
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+
+	verify := func(snap *Snapshot, n int, val func(int) string) {
+		i := 0
+		itr := snap.NewIterator()
+		defer itr.Close()
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			k, v := KVFromBytes(itr.Get())
+			if string(k) != fmt.Sprintf("%010d", i) || string(v) != val(i) {
+				t.Errorf("Expected %d:%s, got %s:%s", i, val(i), k, v)
+			}
+			i++
+		}
+
+		if i != n {
+			t.Errorf("Expected %d items, got %d", n, i)
+		}
+
+		if c := int(snap.Count()); c != n {
+			t.Errorf("Expected snapshot count %d, got %d", n, c)
+		}
+	}
+
+	verify(snap1, 1000, func(int) string { return "v1" })
+	verify(snap2, 2000, func(i int) string {
+		if i >= 1000 && i < 1500 {
+			return "v3"
+		}
+		return "v2"
+	})
+}
+
+func TestConcurrentUpsert(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	n := 16
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	// A key being replaced by an upsert should always be visible to the
+	// other writers. Hence, a concurrent put of the key should fail and the
+	// upsert should not fail after the old item is removed.
+	var stop int32
+	var puts int64
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		pw := db.NewWriter()
+		for i := 0; atomic.LoadInt32(&stop) == 0; i++ {
+			if pw.Put2([]byte(fmt.Sprintf("%010d", i%n))) != nil {
+				atomic.AddInt64(&puts, 1)
+			}
+		}
+	}()
+
+	uw := db.NewWriter()
+	for round := 0; round < 2000; round++ {
+		snap, _ := uw.NewSnapshot()
+		snap.Close()
+
+		for i := 0; i < n; i++ {
+			if old, inserted := uw.Upsert([]byte(fmt.Sprintf("%010d", i))); old == nil || !inserted {
+				t.Errorf("Round %d: expected upsert to replace item %d", round, i)
+			}
+		}
+	}
+
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+
+	if puts != 0 {
+		t.Errorf("Expected puts of the existing keys to fail, got %d", puts)
+	}
+
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+	i := 0
+	itr := snap.NewIterator()
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if k := fmt.Sprintf("%010d", i); string(itr.Get()) != k {
+			t.Fatalf("Expected %s, got %s", k, itr.Get())
+		}
+		i++
+	}
+
+	if i != n || snap.Count() != int64(n) {
+		t.Errorf("Expected %d items, got %d (count %d)", n, i, snap.Count())
+	}
+}
+
+func TestBatchOps(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	var batch [][]byte
+	for _, i := range rand.Perm(10000) {
+		batch = append(batch, []byte(fmt.Sprintf("%010d", i)))
+	}
+	// Duplicate item
+	batch = append(batch, batch[0])
+
+	nodes := w.PutBatch(batch)
+	for i, n := range nodes[:10000] {
+		if n == nil {
+			t.Errorf("Expected insert to succeed for %s", batch[i])
+		}
+	}
+
+	if nodes[10000] != nil {
+		t.Errorf("Expected the duplicate insert to fail")
+	}
+
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+	VerifyCount(snap1, 10000, t)
+
+	var delBatch [][]byte
+	for i := 9999; i >= 0; i -= 2 {
+		delBatch = append(delBatch, []byte(fmt.Sprintf("%010d", i)))
+	}
+	delBatch = append(delBatch, []byte("missing"))
+
+	status := w.DeleteBatch(delBatch)
+	for i, ok := range status {
+		if ok != (i < 5000) {
+			t.Errorf("Unexpected delete status for %s", delBatch[i])
+		}
+	}
+
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+	VerifyCount(snap1, 10000, t)
+	VerifyCount(snap2, 5000, t)
+
+	itr := snap2.NewIterator()
+	defer itr.Close()
+	i := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if exp := fmt.Sprintf("%010d", i); string(itr.Get()) != exp {
+			t.Errorf("Expected %s, got %s", exp, itr.Get())
+		}
+		i += 2
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	// Items inserted after the last snapshot are removed immediately
+	for i := 10000; i < 11000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	w.Delete([]byte(fmt.Sprintf("%010d", 2500)))
+	n, err := w.DeleteRange([]byte(fmt.Sprintf("%010d", 2000)), []byte(fmt.Sprintf("%010d", 3000)))
+	if err != nil || n != 999 {
+		t.Errorf("Expected 999 deletes, got %d (err=%v)", n, err)
+	}
+
+	if n, _ := w.DeleteRange([]byte(fmt.Sprintf("%010d", 9500)), nil); n != 1500 {
+		t.Errorf("Expected 1500 deletes, got %d", n)
+	}
+
+	if _, err := w.DeleteRange([]byte("b"), []byte("a")); err != ErrInvalidRange {
+		t.Errorf("Expected ErrInvalidRange, got %v", err)
+	}
+
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+	VerifyCount(snap1, 10000, t)
+	VerifyCount(snap2, 8500, t)
+
+	if c := int(snap2.Count()); c != 8500 {
+		t.Errorf("Expected snapshot count 8500, got %d", c)
+	}
+
+	if _, ok := snap2.Get([]byte(fmt.Sprintf("%010d", 2999))); ok {
+		t.Errorf("Expected item to be deleted")
+	}
+
+	if _, ok := snap2.Get([]byte(fmt.Sprintf("%010d", 3000))); !ok {
+		t.Errorf("Expected item to be present")
+	}
+}
+
+func TestRangeIterator(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%04d", i)))
+	}
+	w.Delete([]byte("0150"))
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	collect := func(itr *Iterator) (keys []string) {
+		defer itr.Close()
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			keys = append(keys, string(itr.Get()))
+		}
+		return
+	}
+
+	keys := collect(snap.NewRangeIterator([]byte("0100"), []byte("0200"), false))
+	if len(keys) != 99 || keys[0] != "0100" || keys[98] != "0199" {
+		t.Errorf("Unexpected range scan result %v", keys)
+	}
+
+	keys = collect(snap.NewRangeIterator([]byte("0100"), []byte("0200"), true))
+	if len(keys) != 100 || keys[99] != "0200" {
+		t.Errorf("Unexpected inclusive range scan result %v", keys)
+	}
+
+	keys = collect(snap.NewRangeIterator(nil, []byte("0010"), false))
+	if len(keys) != 10 || keys[0] != "0000" {
+		t.Errorf("Unexpected range scan result %v", keys)
+	}
+
+	keys = collect(snap.NewPrefixIterator([]byte("099")))
+	if len(keys) != 10 || keys[0] != "0990" || keys[9] != "0999" {
+		t.Errorf("Unexpected prefix scan result %v", keys)
+	}
+
+	keys = collect(snap.NewPrefixIterator([]byte("5")))
+	if len(keys) != 0 {
+		t.Errorf("Expected empty prefix scan result, got %v", keys)
+	}
+
+	itr := snap.NewRangeIterator([]byte("0500"), []byte("0600"), false)
+	defer itr.Close()
+	itr.Seek([]byte("0000"))
+	if !itr.Valid() || string(itr.Get()) != "0500" {
+		t.Errorf("Expected seek to be bounded by the range start")
+	}
+
+	itr.Seek([]byte("0600"))
+	if itr.Valid() {
+		t.Errorf("Expected seek beyond the range end to be invalid")
+	}
+
+	if string(prefixEnd([]byte{'a', 0xff})) != "b" || prefixEnd([]byte{0xff}) != nil {
+		t.Errorf("Unexpected prefix end")
+	}
+}
+
+func TestReverseIterator(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%04d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	// Create newer versions which are invisible to snap1
+	for i := 0; i < 1000; i += 3 {
+		w.Delete([]byte(fmt.Sprintf("%04d", i)))
+	}
+	for i := 0; i < 1000; i += 6 {
+		w.Put([]byte(fmt.Sprintf("%04d", i)))
+	}
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+
+	collect := func(itr *Iterator) (keys []string) {
+		defer itr.Close()
+		for itr.SeekLast(); itr.Valid(); itr.Prev() {
+			keys = append(keys, string(itr.Get()))
+		}
+		return
+	}
+
+	keys := collect(snap1.NewIterator())
+	if len(keys) != 1000 || keys[0] != "0999" || keys[999] != "0000" {
+		t.Errorf("Unexpected reverse scan of %d items", len(keys))
+	}
+
+	keys = collect(snap2.NewIterator())
+	for i, k := range keys[1:] {
+		if k >= keys[i] {
+			t.Errorf("Unexpected reverse scan order %s >= %s", k, keys[i])
+		}
+	}
+	if exp := CountItems(snap2); len(keys) != exp {
+		t.Errorf("Expected %d items, got %d", exp, len(keys))
+	}
+
+	keys = collect(snap1.NewRangeIterator([]byte("0100"), []byte("0200"), false))
+	if len(keys) != 100 || keys[0] != "0199" || keys[99] != "0100" {
+		t.Errorf("Unexpected reverse range scan result %v", keys)
+	}
+
+	keys = collect(snap1.NewRangeIterator([]byte("0100"), []byte("0200"), true))
+	if len(keys) != 101 || keys[0] != "0200" {
+		t.Errorf("Unexpected reverse inclusive range scan result %v", keys)
+	}
+
+	keys = collect(snap2.NewPrefixIterator([]byte("012")))
+	if len(keys) != 8 || keys[0] != "0128" || keys[7] != "0120" {
+		t.Errorf("Unexpected reverse prefix scan result %v", keys)
+	}
+
+	itr := snap2.NewIterator()
+	defer itr.Close()
+	itr.SeekForPrev([]byte("0501"))
+	if !itr.Valid() || string(itr.Get()) != "0500" {
+		t.Errorf("Expected SeekForPrev() to skip the deleted item")
+	}
+
+	itr.SeekForPrev([]byte("0504"))
+	if !itr.Valid() || string(itr.Get()) != "0504" {
+		t.Errorf("Expected SeekForPrev() to find the reinserted item")
+	}
+
+	if itr.Next(); !itr.Valid() || string(itr.Get()) != "0505" {
+		t.Errorf("Expected Next() after SeekForPrev() to move forward")
+	}
+}
+
+func TestLoadStoreLargeItems(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 100; i++ {
+		itm := make([]byte, 70000+i*1000)
+		copy(itm, fmt.Sprintf("%010d", i))
+		w.Put(itm)
+	}
+	snap, _ := w.NewSnapshot()
+
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	snap2, err := db2.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	defer snap2.Close()
+
+	i := 0
+	itr := snap2.NewIterator()
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		itm := itr.Get()
+		if len(itm) != 70000+i*1000 || string(itm[:10]) != fmt.Sprintf("%010d", i) {
+			t.Errorf("Item %d mismatch: len=%d", i, len(itm))
+		}
+		i++
+	}
+
+	if i != 100 {
+		t.Errorf("Expected 100 items, got %d", i)
+	}
+}
+
+func dirSize(dir string) int64 {
+	var sz int64
+	filepath.Walk(dir, func(_ string, fi os.FileInfo, _ error) error {
+		if fi != nil && !fi.IsDir() {
+			sz += fi.Size()
+		}
+		return nil
+	})
+	return sz
+}
+
+func TestLoadStoreCompressed(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+	os.RemoveAll("db2.dump")
+	defer os.RemoveAll("db2.dump")
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	n := 100000
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("index_key_%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := testConf
+	if err := conf.SetFileType(CompressedFile); err != nil {
+		t.Fatal(err)
+	}
+	db.fileType = CompressedFile
+	if err := db.StoreToDisk("db2.dump", snap, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if raw, compressed := dirSize("db.dump"), dirSize("db2.dump"); compressed >= raw/2 {
+		t.Errorf("Expected compressed backup to be smaller: raw=%d, compressed=%d", raw, compressed)
+	}
+
+	db3 := NewWithConfig(conf)
+	defer db3.Close()
+	snap3, err := db3.LoadFromDisk("db2.dump", 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap3.Close()
+
+	i := 0
+	itr := snap3.NewIterator()
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if exp := fmt.Sprintf("index_key_%010d", i); string(itr.Get()) != exp {
+			t.Errorf("Expected %s, got %s", exp, itr.Get())
+		}
+		i++
+	}
+
+	if i != n {
+		t.Errorf("Expected %d items, got %d", n, i)
+	}
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	dirs := []string{"db.dump", "db.inc1", "db.inc2"}
+	for _, dir := range dirs {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+	snap1.Open()
+	if err := db.StoreToDisk(dirs[0], snap1, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10000; i += 3 {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	for i := 10000; i < 15000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+	snap2.Open()
+	if err := db.StoreIncrementalToDisk(dirs[1], snap1.sn, snap2, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+	snap1.Close()
+
+	for i := 0; i < 15000; i += 5 {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	for i := 15000; i < 18000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap3, _ := w.NewSnapshot()
+	defer snap3.Close()
+	snap3.Open()
+	if err := db.StoreIncrementalToDisk(dirs[2], snap2.sn, snap3, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	snap3.Open()
+	if err := db.StoreIncrementalToDisk("db.inc3", snap1.sn, snap3, 4, nil); err != ErrInvalidIncrementalBase {
+		t.Errorf("Expected invalid base error, got %v", err)
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	if _, err := db2.LoadFromDisk(dirs[1], 4, nil); err != ErrIncrementalBackup {
+		t.Errorf("Expected incremental backup error, got %v", err)
+	}
+
+	snap4, err := db2.LoadIncrementalFromDisk(dirs, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap4.Close()
+
+	if snap3.sn != snap4.sn {
+		t.Errorf("Expected snapshot number %d, got %d", snap3.sn, snap4.sn)
+	}
+
+	if snap3.Count() != snap4.Count() {
+		t.Errorf("Expected %d items, got %d", snap3.Count(), snap4.Count())
+	}
+
+	itr1 := snap3.NewIterator()
+	defer itr1.Close()
+	itr2 := snap4.NewIterator()
+	defer itr2.Close()
+	itr2.SeekFirst()
+	for itr1.SeekFirst(); itr1.Valid(); itr1.Next() {
+		if !itr2.Valid() || !bytes.Equal(itr1.Get(), itr2.Get()) {
+			t.Fatalf("Mismatch at item %s", itr1.Get())
+		}
+		itr2.Next()
+	}
+
+	if itr2.Valid() {
+		t.Errorf("Unexpected item %s", itr2.Get())
+	}
+}
+
+func TestBackupSnapshotNumber(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	n := 1000
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+		if i%100 == 0 {
+			snap, _ := w.NewSnapshot()
+			snap.Close()
+		}
+	}
+
+	snap, _ := w.NewSnapshot()
+	sn := snap.sn
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	man, err := readManifest("db.dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if man.Sn != sn || man.ItemsCount != int64(n) || len(man.Files) != runtime.NumCPU() {
+		t.Errorf("Unexpected manifest %+v", man)
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	snap2, err := db2.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if snap2.sn != sn {
+		t.Errorf("Expected snapshot number %d, got %d", sn, snap2.sn)
+	}
+
+	w2 := db2.NewWriter()
+	for i := 0; i < n; i++ {
+		w2.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	snap3, _ := w2.NewSnapshot()
+	if snap3.sn != sn+1 {
+		t.Errorf("Expected snapshot number %d, got %d", sn+1, snap3.sn)
+	}
+
+	// Deleted items should be garbage collected
+	snap2.Close()
+	snap3.Close()
+	for i := 0; i < 1000 && db2.store.GetStats().NodeCount != 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if c := db2.store.GetStats().NodeCount; c != 0 {
+		t.Errorf("Expected all items to be collected, got %d", c)
+	}
+}
+
+func TestBackupCommit(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10000; i += 2 {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ = w.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if tmps, _ := filepath.Glob("db.dump.tmp*"); len(tmps) != 0 {
+		t.Errorf("Unexpected temporary directories %v", tmps)
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	snap2, err := db2.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := snap2.Count(); c != 5000 {
+		t.Errorf("Expected 5000 items, got %d", c)
+	}
+	snap2.Close()
+
+	// Modified shard file
+	path := filepath.Join("db.dump", "data", "shard-0")
+	bs, _ := ioutil.ReadFile(path)
+	bs[len(bs)/2] ^= 0xff
+	ioutil.WriteFile(path, bs, 0660)
+	db5 := NewWithConfig(testConf)
+	defer db5.Close()
+	if _, err := db5.LoadFromDisk("db.dump", 4, nil); err == nil {
+		t.Errorf("Expected an error for modified file")
+	} else if _, ok := err.(*CorruptionError); !ok {
+		t.Errorf("Expected corruption error, got %v", err)
+	}
+
+	db6 := NewWithConfig(testConf)
+	defer db6.Close()
+	opts := BackupOptions{VerifyChecksums: true}
+	if _, err := db6.LoadFromDiskWithOptions(context.Background(), "db.dump", 4, nil, opts); err == nil {
+		t.Errorf("Expected an error for modified file")
+	} else if ce, ok := err.(*CorruptionError); !ok || ce.Reason != "file checksum mismatch" {
+		t.Errorf("Expected file checksum mismatch, got %v", err)
+	}
+	bs[len(bs)/2] ^= 0xff
+	ioutil.WriteFile(path, bs, 0660)
+
+	// Truncated shard file
+	fi, _ := os.Stat(path)
+	os.Truncate(path, fi.Size()-1)
+	db3 := NewWithConfig(testConf)
+	defer db3.Close()
+	if _, err := db3.LoadFromDisk("db.dump", 4, nil); err == nil {
+		t.Errorf("Expected an error for truncated file")
+	} else if _, ok := err.(*CorruptionError); !ok {
+		t.Errorf("Expected corruption error, got %v", err)
+	}
+
+	// Modified manifest
+	path = filepath.Join("db.dump", manifestFile)
+	bs, _ = ioutil.ReadFile(path)
+	ioutil.WriteFile(path, bytes.Replace(bs, []byte(`"ItemsCount":5000`), []byte(`"ItemsCount":5001`), 1), 0660)
+	if _, err := readManifest("db.dump"); err == nil {
+		t.Errorf("Expected an error for modified manifest")
+	}
+
+	// Missing manifest
+	os.Remove(path)
+	db4 := NewWithConfig(testConf)
+	defer db4.Close()
+	if _, err := db4.LoadFromDisk("db.dump", 4, nil); err != ErrInvalidBackup {
+		t.Errorf("Expected invalid backup error, got %v", err)
+	}
+}
+
+func TestBackupFileChecksums(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	for _, n := range []int{0, 1, 100, 70000} {
+		bs1 := make([]byte, n)
+		bs2 := make([]byte, n/3)
+		rand.Read(bs1)
+		rand.Read(bs2)
+		crc1 := crc32.Checksum(bs1, crcTable)
+		crc2 := crc32.Checksum(bs2, crcTable)
+		exp := crc32.Checksum(append(bs1, bs2...), crcTable)
+		if got := crc32Combine(crc1, crc2, int64(len(bs2))); got != exp {
+			t.Errorf("Expected combined crc %x, got %x", exp, got)
+		}
+	}
+
+	// A stale temporary directory of an interrupted backup
+	stale := "db.dump.tmp-stale"
+	os.MkdirAll(filepath.Join(stale, "data"), 0755)
+	defer os.RemoveAll(stale)
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+
+	sums := newFileChecksums()
+	tmpdir, err := newBackupDir("db.dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	man, err := db.storeToDisk(context.Background(), tmpdir, snap, 4, 4, nil, nil, sums)
+	if err = commitBackup(tmpdir, "db.dump", man, sums, err); err != nil {
+		t.Fatal(err)
+	}
+
+	man, err = readManifest("db.dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The shard files are not read again for the manifest
+	var written int
+	for _, file := range man.checksumFiles() {
+		if cs, ok := sums.get(filepath.Join(tmpdir, filepath.FromSlash(file))); ok {
+			if cs != man.Checksums[file] {
+				t.Errorf("Expected checksum %+v for %s, got %+v", man.Checksums[file], file, cs)
+			}
+			written++
+		}
+	}
+
+	if written < 4 {
+		t.Errorf("Expected checksums of the shard files, got %d", written)
+	}
+
+	if err := verifyFileChecksums("db.dump", man); err != nil {
+		t.Errorf("Unexpected verification error %v", err)
+	}
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("Expected stale directory to be removed, got %v", err)
+	}
+
+	// A backup in progress is not removed
+	tmpdir, err = newBackupDir("db.dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readManifest("db.dump"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(tmpdir); err != nil {
+		t.Errorf("Expected backup directory in progress, got %v", err)
+	}
+	commitBackup(tmpdir, "db.dump", nil, nil, ErrShutdown)
+}
+
+func TestBackupCommitRecovery(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+	os.RemoveAll("db.dump.old")
+	defer os.RemoveAll("db.dump.old")
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	load := func(n int64) {
+		db2 := NewWithConfig(testConf)
+		defer db2.Close()
+		snap2, err := db2.LoadFromDisk("db.dump", 4, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer snap2.Close()
+
+		if c := snap2.Count(); c != n {
+			t.Errorf("Expected %d items, got %d", n, c)
+		}
+
+		if _, err := os.Stat("db.dump.old"); !os.IsNotExist(err) {
+			t.Errorf("Expected old backup directory to be removed")
+		}
+	}
+
+	// Crash after the old backup directory is moved aside
+	if err := os.Rename("db.dump", "db.dump.old"); err != nil {
+		t.Fatal(err)
+	}
+	load(1000)
+
+	// Crash before the old backup directory is removed
+	os.MkdirAll(filepath.Join("db.dump.old", "data"), 0755)
+	ioutil.WriteFile(filepath.Join("db.dump.old", "data", "shard-0"), []byte("old"), 0660)
+	load(1000)
+
+	// A new backup should replace the backup directory even if the old
+	// backup directory was left behind
+	os.MkdirAll(filepath.Join("db.dump.old", "data"), 0755)
+	for i := 1000; i < 2000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ = w.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+	load(2000)
+}
+
+func TestDiffIterator(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 100; i++ {
+		w.Put([]byte(fmt.Sprintf("%05d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	expected := make(map[string]DiffType)
+	for i := 0; i < 100; i += 10 {
+		k := fmt.Sprintf("%05d", i)
+		w.Delete([]byte(k))
+		expected[k] = DiffRemoved
+	}
+
+	for i := 100; i < 110; i++ {
+		k := fmt.Sprintf("%05d", i)
+		w.Put([]byte(k))
+		expected[k] = DiffAdded
+	}
+
+	w.Put([]byte("00200"))
+	mid, _ := w.NewSnapshot()
+	mid.Close()
+	w.Delete([]byte("00200"))
+
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+
+	if _, err := db.NewDiffIterator(snap2, snap1); err != ErrInvalidDiffSnapshots {
+		t.Errorf("Expected invalid snapshots error, got %v", err)
+	}
+
+	itr, err := db.NewDiffIterator(snap1, snap2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer itr.Close()
+
+	count := 0
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		typ, ok := expected[string(itr.Get())]
+		if !ok || typ != itr.Type() {
+			t.Errorf("Unexpected item %s type %d", itr.Get(), itr.Type())
+		}
+		count++
+	}
+
+	if count != len(expected) {
+		t.Errorf("Expected %d changes, got %d", len(expected), count)
+	}
+}
+
+func TestOpenSnapshot(t *testing.T) {
+	conf := testConf
+	conf.RetainSnapshots(3)
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	var sns []uint32
+	w := db.NewWriter()
+	for i := 0; i < 5; i++ {
+		w.Put([]byte(fmt.Sprintf("%d", i)))
+		snap, _ := w.NewSnapshot()
+		if snap.SnGen() != 0 {
+			t.Errorf("Expected generation 0, got %d", snap.SnGen())
+		}
+		sns = append(sns, snap.Sn())
+		snap.Close()
+	}
+
+	for i, sn := range sns {
+		snap, err := db.OpenSnapshot(0, sn)
+		if i < 2 {
+			if err != ErrSnapshotNotFound {
+				t.Errorf("Expected snapshot %d to be collected, got %v", sn, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("Expected snapshot %d, got %v", sn, err)
+		}
+
+		if snap.Count() != int64(i+1) {
+			t.Errorf("Expected %d items, got %d", i+1, snap.Count())
+		}
+
+		if _, ok := snap.Get([]byte(fmt.Sprintf("%d", i+1))); ok {
+			t.Errorf("Unexpected item in snapshot %d", sn)
+		}
+		snap.Close()
+	}
+
+	// The snapshot number of another generation should not match
+	if _, err := db.OpenSnapshot(1, sns[4]); err != ErrSnapshotNotFound {
+		t.Errorf("Expected snapshot not found error, got %v", err)
+	}
+}
+
+func countItems(snap *Snapshot) int {
+	var count int
+	itr := snap.NewIterator()
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		count++
+	}
+
+	return count
+}
+
+func TestConcurrentSnapshot(t *testing.T) {
+	var wg sync.WaitGroup
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	nw, n := 4, 100000
+	done := make(chan struct{})
+	for i := 0; i < nw; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			w := db.NewWriter()
+			for j := 0; j < n; j++ {
+				w.Put([]byte(fmt.Sprintf("%d-%010d", id, j)))
+				if j%2 == 0 {
+					w.Delete([]byte(fmt.Sprintf("%d-%010d", id, j/2)))
+				}
+			}
+		}(i)
+	}
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var nsnaps int
+loop:
+	for {
+		select {
+		case <-done:
+			break loop
+		default:
+		}
+
+		snap, err := db.NewSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Later writes should not be visible in the snapshot
+		for k := 0; k < 2; k++ {
+			if c := countItems(snap); c != int(snap.Count()) {
+				t.Fatalf("Expected %d items in snapshot %d, got %d", snap.Count(), snap.sn, c)
+			}
+		}
+		snap.Close()
+		nsnaps++
+	}
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	if expected := nw * n / 2; snap.Count() != int64(expected) || countItems(snap) != expected {
+		t.Errorf("Expected %d items, got %d", expected, snap.Count())
+	}
+	t.Logf("Created %d snapshots", nsnaps)
+}
+
+// setSnRange sets the snapshot number aging interval and range for a test
+func setSnRange(interval, maxRange uint32) func() {
+	oldInterval, oldRange := snAgeInterval, snMaxRange
+	snAgeInterval, snMaxRange = interval, maxRange
+	return func() {
+		snAgeInterval, snMaxRange = oldInterval, oldRange
+	}
+}
+
+// waitAgeSn waits for the aging scan started by NewSnapshot
+func waitAgeSn(db *Nitro) {
+	for atomic.LoadInt32(&db.aging) != 0 {
+		runtime.Gosched()
+	}
+}
+
+func TestSnapshotWrap(t *testing.T) {
+	defer setSnRange(8, 64)()
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	db.restoreSn(0, math.MaxUint32-25)
+
+	w := db.NewWriter()
+	expected := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprintf("%010d", i)
+		w.Put([]byte(k))
+		expected[k] = true
+		if i%50 == 0 {
+			snap, _ := w.NewSnapshot()
+			snap.Close()
+			waitAgeSn(db)
+		}
+	}
+
+	// A snapshot from before the wrap around remains usable
+	held, _ := w.NewSnapshot()
+	heldItems := make(map[string]bool)
+	for k := range expected {
+		heldItems[k] = true
+	}
+
+	for i := 0; i < 10; i++ {
+		k := fmt.Sprintf("%010d", i)
+		w.Delete([]byte(k))
+		delete(expected, k)
+		snap, err := w.NewSnapshot()
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		snap.Close()
+		waitAgeSn(db)
+	}
+
+	if db.getSnGen() != 1 || db.getCurrSn() > 10 {
+		t.Errorf("Expected snapshot numbers to wrap around, got generation %d and sn %d",
+			db.getSnGen(), db.getCurrSn())
+	}
+
+	checkItems(t, held, heldItems)
+	if snap, err := db.OpenSnapshot(0, held.Sn()); err != nil || snap != held {
+		t.Errorf("Expected the snapshot of the previous generation, got %v", err)
+	} else {
+		snap.Close()
+	}
+
+	k := fmt.Sprintf("%010d", 1000)
+	w.Put([]byte(k))
+	expected[k] = true
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+	checkItems(t, snap, expected)
+	if snap.Count() != int64(len(expected)) {
+		t.Errorf("Expected count %d, got %d", len(expected), snap.Count())
+	}
+
+	// Items written before the wrap around can be replaced and deleted
+	w.Upsert([]byte(fmt.Sprintf("%010d", 10)))
+	w.Delete([]byte(fmt.Sprintf("%010d", 11)))
+	delete(expected, fmt.Sprintf("%010d", 11))
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+	checkItems(t, snap2, expected)
+	if _, ok := snap.Get([]byte(fmt.Sprintf("%010d", 11))); !ok {
+		t.Errorf("Expected item to be visible in the older snapshot")
+	}
+
+	itr, err := db.NewDiffIterator(held, snap2)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var added, removed int
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if itr.Type() == DiffAdded {
+			added++
+		} else {
+			removed++
+		}
+	}
+	itr.Close()
+
+	// The upserted item is a new version of the item
+	if added != 2 || removed != 12 {
+		t.Errorf("Expected 2 added and 12 removed items, got %d and %d", added, removed)
+	}
+
+	// The snapshot number of the new generation does not open the snapshot
+	// of the previous generation
+	if _, err := db.OpenSnapshot(1, held.Sn()); err != ErrSnapshotNotFound {
+		t.Errorf("Expected snapshot not found error, got %v", err)
+	}
+	held.Close()
+}
+
+func TestSnapshotWrapOpenSnapshots(t *testing.T) {
+	defer setSnRange(8, 32)()
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	db.restoreSn(0, math.MaxUint32-100)
+
+	// The latest snapshot is always open
+	w := db.NewWriter()
+	expected := make(map[string]bool)
+	prev, _ := db.NewSnapshot()
+	for i := 0; i < 300; i++ {
+		k := fmt.Sprintf("%010d", i)
+		w.Put([]byte(k))
+		expected[k] = true
+		if i%3 == 0 {
+			k = fmt.Sprintf("%010d", i/3)
+			w.Delete([]byte(k))
+			delete(expected, k)
+		}
+
+		snap, err := db.NewSnapshot()
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		prev.Close()
+		prev = snap
+		waitAgeSn(db)
+	}
+
+	if db.getSnGen() != 1 {
+		t.Errorf("Expected snapshot numbers to wrap around, got generation %d", db.getSnGen())
+	}
+	checkItems(t, prev, expected)
+
+	// The items are aged along with the snapshots
+	sn := db.getCurrSn()
+	iter := db.store.NewIterator(db.iterCmp, db.store.MakeBuf())
+	for iter.SeekFirst(); iter.Valid(); iter.Next() {
+		itm := (*Item)(iter.Get())
+		if uint32(sn-itm.bornSn) >= snMaxRange {
+			t.Errorf("Expected aged item, got bornSn %d with sn %d", itm.bornSn, sn)
+			break
+		}
+	}
+	iter.Close()
+
+	// An old snapshot limits the range of snapshot numbers
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		var snap *Snapshot
+		if snap, err = db.NewSnapshot(); err == nil {
+			snap.Close()
+			waitAgeSn(db)
+		}
+	}
+
+	if err != ErrMaxSnapshotsLimitReached {
+		t.Errorf("Expected max snapshots limit error, got %v", err)
+	}
+
+	checkItems(t, prev, expected)
+	prev.Close()
+	db.NewSnapshot()
+	waitAgeSn(db)
+	snap, err := db.NewSnapshot()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer snap.Close()
+	checkItems(t, snap, expected)
+}
+
+func TestSnapshotWrapDeltaBackup(t *testing.T) {
+	defer setSnRange(8, 64)()
+
+	os.RemoveAll("db.dump")
+	conf := testConf
+	conf.UseDeltaInterleaving()
+	db := NewWithConfig(conf)
+	defer db.Close()
+	db.restoreSn(0, math.MaxUint32-20)
+
+	w := db.NewWriter()
+	for i := 0; i < 100; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := db.NewSnapshot()
+	sn := snap.Sn()
+
+	// The backup snapshot is closed while the items are visited
+	var once sync.Once
+	callb := func(itm *ItemEntry) {
+		once.Do(func() {
+			for i := 0; i < 50; i++ {
+				w.Delete([]byte(fmt.Sprintf("%010d", i)))
+				snap, err := db.NewSnapshot()
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+					return
+				}
+				snap.Close()
+				waitAgeSn(db)
+			}
+
+			if agedSn := atomic.LoadUint32(&db.agedSn); snCompare(agedSn, sn) > 0 {
+				t.Errorf("Expected items to be aged up to %d, got %d", sn, agedSn)
+			}
+		})
+	}
+
+	if err := db.StoreToDisk("db.dump", snap, 1, callb); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if gen := db.getSnGen(); gen != 1 {
+		t.Errorf("Expected snapshot numbers to wrap around, got generation %d", gen)
+	}
+
+	db2 := NewWithConfig(conf)
+	defer db2.Close()
+	snap, err := db2.LoadFromDisk("db.dump", 1, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer snap.Close()
+
+	if snap.Count() != 100 || db2.getSnGen() != 0 {
+		t.Errorf("Expected 100 items in generation 0, got %d in %d", snap.Count(), db2.getSnGen())
+	}
+}
+
+func TestWriterClose(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	n := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		wr := db.NewWriter()
+		for j := 0; j < 100; j++ {
+			wr.Put([]byte(fmt.Sprintf("%d-%010d", i, j)))
+		}
+
+		snap, _ := w.NewSnapshot()
+		snap.Close()
+		for j := 0; j < 100; j += 2 {
+			wr.Delete([]byte(fmt.Sprintf("%d-%010d", i, j)))
+		}
+		wr.Close()
+	}
+
+	snap, _ := w.NewSnapshot()
+	if db.numWriters() != 1 {
+		t.Errorf("Expected closed writers to be removed, got %d writers", db.numWriters())
+	}
+
+	if snap.Count() != 500 {
+		t.Errorf("Expected 500 items, got %d", snap.Count())
+	}
+	snap.Close()
+
+	// Deleted items of the closed writers should be collected
+	snap, _ = w.NewSnapshot()
+	snap.Close()
+	for i := 0; i < 1000; i++ {
+		if db.store.GetStats().NodeCount == 500 && runtime.NumGoroutine() <= n {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if c := db.store.GetStats().NodeCount; c != 500 {
+		t.Errorf("Expected 500 nodes, got %d", c)
+	}
+
+	if c := runtime.NumGoroutine(); c > n {
+		t.Errorf("Expected writer workers to exit, got %d goroutines", c-n)
+	}
+}
+
+func TestWriterPool(t *testing.T) {
+	var wg sync.WaitGroup
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	pool := db.NewWriterPool(2)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				w := pool.Get()
+				w.Put([]byte(fmt.Sprintf("%d-%010d", id, j)))
+				pool.Put(w)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if db.numWriters() > 4 {
+		t.Errorf("Expected writers to be reused, got %d writers", db.numWriters())
+	}
+
+	pool.Close()
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	if db.numWriters() != 1 {
+		t.Errorf("Expected closed writers to be removed, got %d writers", db.numWriters())
+	}
+
+	if snap.Count() != 400 {
+		t.Errorf("Expected 400 items, got %d", snap.Count())
+	}
+}
+
+func TestStoreToDiskCancel(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 100000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	snap.Open()
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100000; i += 2 {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap2, _ := w.NewSnapshot()
+
+	var count int64
+	ctx, cancel := context.WithCancel(context.Background())
+	callb := func(*ItemEntry) {
+		if atomic.AddInt64(&count, 1) == 1000 {
+			cancel()
+		}
+	}
+
+	if err := db.StoreToDiskContext(ctx, "db.dump", snap2, 4, callb); err != context.Canceled {
+		t.Errorf("Expected context cancelled error, got %v", err)
+	}
+
+	if count >= 50000 {
+		t.Errorf("Expected backup to stop early, visited %d items", count)
+	}
+
+	if tmps, _ := filepath.Glob("db.dump.tmp*"); len(tmps) != 0 {
+		t.Errorf("Unexpected temporary directories %v", tmps)
+	}
+
+	// The older backup should be retained
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	snap3, err := db2.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap3.Close()
+
+	if snap3.Count() != 100000 {
+		t.Errorf("Expected 100000 items, got %d", snap3.Count())
+	}
+	snap.Close()
+}
+
+func TestLoadFromDiskCancel(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 100000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+
+	var count int64
+	ctx, cancel := context.WithCancel(context.Background())
+	callb := func(*ItemEntry) {
+		if atomic.AddInt64(&count, 1) == 1000 {
+			cancel()
+		}
+	}
+
+	if _, err := db2.LoadFromDiskContext(ctx, "db.dump", 4, callb); err != context.Canceled {
+		t.Errorf("Expected context cancelled error, got %v", err)
+	}
+
+	if count >= 100000 {
+		t.Errorf("Expected restore to stop early, restored %d items", count)
+	}
+
+	if c := db2.ItemsCount(); c != 0 {
+		t.Errorf("Expected partially restored items to be removed, got %d", c)
+	}
+
+	// The instance should be usable for another restore
+	snap2, err := db2.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap2.Close()
+
+	if c := countItems(snap2); c != 100000 {
+		t.Errorf("Expected 100000 items, got %d", c)
+	}
+}
+
+func TestBackupOptions(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	n := 100000
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+
+	var last BackupProgress
+	done := make(map[int]bool)
+	opts := BackupOptions{
+		Progress: func(p BackupProgress) {
+			if p.Items < last.Items || p.EstimatedItems != int64(n) {
+				t.Errorf("Unexpected progress %+v after %+v", p, last)
+			}
+			if p.ShardDone {
+				done[p.Shard] = true
+			}
+			last = p
+		},
+		MaxBytesPerSec: 2 * 1024 * 1024,
+	}
+
+	t0 := time.Now()
+	err := db.StoreToDiskWithOptions(context.Background(), "db.dump", snap, 4, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1MB of item bytes at 2MB/s
+	if dur := time.Since(t0); dur < time.Millisecond*400 {
+		t.Errorf("Expected backup to be throttled, took %v", dur)
+	}
+
+	if last.Items != int64(n) || last.Bytes != int64(n*10) {
+		t.Errorf("Expected %d items and %d bytes, got %+v", n, n*10, last)
+	}
+
+	if len(done) != runtime.NumCPU() {
+		t.Errorf("Expected completion of %d shards, got %v", runtime.NumCPU(), done)
+	}
+
+	last = BackupProgress{}
+	done = make(map[int]bool)
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+
+	t0 = time.Now()
+	snap2, err := db2.LoadFromDiskWithOptions(context.Background(), "db.dump", 4, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap2.Close()
+
+	if dur := time.Since(t0); dur < time.Millisecond*400 {
+		t.Errorf("Expected restore to be throttled, took %v", dur)
+	}
+
+	if last.Items != int64(n) || len(done) != runtime.NumCPU() {
+		t.Errorf("Expected %d items from %d shards, got %+v %v", n, runtime.NumCPU(), last, done)
+	}
+
+	if snap2.Count() != int64(n) {
+		t.Errorf("Expected %d items, got %d", n, snap2.Count())
+	}
+}
+
+func TestIncrementalBackupOptions(t *testing.T) {
+	dirs := []string{"db.dump", "db.inc1"}
+	for _, dir := range dirs {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+	snap1.Open()
+	if err := db.StoreToDisk(dirs[0], snap1, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1000 deleted and 1000 new items
+	for i := 0; i < 1000; i++ {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+		w.Put([]byte(fmt.Sprintf("%010d", i+10000)))
+	}
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+	snap2.Open()
+
+	var last BackupProgress
+	done := make(map[int]bool)
+	opts := BackupOptions{
+		Shards: 3,
+		Progress: func(p BackupProgress) {
+			if p.ShardDone {
+				done[p.Shard] = true
+			}
+			last = p
+		},
+		ProgressInterval: 100,
+	}
+
+	err := db.StoreIncrementalToDiskWithOptions(context.Background(), dirs[1], snap1.sn, snap2, 4, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	man, err := readManifest(dirs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(man.Files) != 3 || len(done) != 3 {
+		t.Errorf("Expected 3 shards, got %d files and %v", len(man.Files), done)
+	}
+
+	if last.Items != 2000 || man.ItemsCount != 2000 {
+		t.Errorf("Expected 2000 items, got %d (manifest %d)", last.Items, man.ItemsCount)
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	snap3, err := db2.LoadIncrementalFromDisk(dirs, 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap3.Close()
+
+	if snap3.Count() != snap2.Count() {
+		t.Errorf("Expected %d items, got %d", snap2.Count(), snap3.Count())
+	}
+
+	// A cancelled backup retains the existing backup
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	snap2.Open()
+	err = db.StoreIncrementalToDiskWithOptions(ctx, dirs[1], snap1.sn, snap2, 4, nil, opts)
+	if err != context.Canceled {
+		t.Errorf("Expected context cancelled error, got %v", err)
+	}
+
+	if _, err := readManifest(dirs[1]); err != nil {
+		t.Errorf("Expected the existing backup to be retained, got %v", err)
+	}
+}
+
+func TestBackupShards(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	// The items in the second half are larger
+	n := 100000
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		k := fmt.Sprintf("%010d", i)
+		if i >= n/2 {
+			k += string(make([]byte, 90))
+		}
+		w.Put([]byte(k))
+	}
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	for _, shards := range []int{1, 3, 16} {
+		snap.Open()
+		opts := BackupOptions{Shards: shards}
+		if err := db.StoreToDiskWithOptions(context.Background(), "db.dump", snap, 4, nil, opts); err != nil {
+			t.Fatal(err)
+		}
+
+		man, err := readManifest("db.dump")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(man.Files) != shards {
+			t.Errorf("Expected %d shard files, got %d", shards, len(man.Files))
+		}
+
+		var sizes []int64
+		var total int64
+		for _, file := range man.Files {
+			fi, _ := os.Stat(filepath.Join("db.dump", "data", file))
+			sizes = append(sizes, fi.Size())
+			total += fi.Size()
+		}
+
+		for _, sz := range sizes {
+			if avg := total / int64(shards); sz < avg/2 || sz > avg*3/2 {
+				t.Errorf("Expected shard files of similar size, got %v", sizes)
+				break
+			}
+		}
+
+		// Restore using a concurrency different from the number of shards
+		for _, concurr := range []int{2, 8} {
+			db2 := NewWithConfig(testConf)
+			snap2, err := db2.LoadFromDisk("db.dump", concurr, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			i := 0
+			itr := snap2.NewIterator()
+			for itr.SeekFirst(); itr.Valid(); itr.Next() {
+				if !bytes.HasPrefix(itr.Get(), []byte(fmt.Sprintf("%010d", i))) {
+					t.Errorf("Expected item %d, got %s", i, itr.Get()[:10])
+					break
+				}
+				i++
+			}
+			itr.Close()
+
+			if i != n || snap2.Count() != int64(n) {
+				t.Errorf("Expected %d items, got %d (count %d)", n, i, snap2.Count())
+			}
+			snap2.Close()
+			db2.Close()
+		}
+	}
+}
+
+func TestKeyComparatorName(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	conf := testConf
+	conf.SetNamedKeyComparator(CompareKV, "kv")
+	db := NewWithConfig(conf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 100; i++ {
+		w.Put(KVToBytes([]byte(fmt.Sprintf("%010d", i)), []byte("v")))
+	}
+	snap, _ := w.NewSnapshot()
+	snap.Open()
+	if err := db.StoreToDisk("db.dump", snap, 2, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := db.StoreToStream(&buf, snap); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"kv", "", "other"} {
+		conf2 := testConf
+		if name == "" {
+			conf2.SetKeyComparator(CompareKV)
+		} else {
+			conf2.SetNamedKeyComparator(CompareKV, name)
+		}
+
+		for _, stream := range []bool{false, true} {
+			var err error
+			var snap2 *Snapshot
+			db2 := NewWithConfig(conf2)
+			if stream {
+				snap2, err = db2.LoadFromStream(bytes.NewReader(buf.Bytes()))
+			} else {
+				snap2, err = db2.LoadFromDisk("db.dump", 2, nil)
+			}
+
+			if name == "other" {
+				if err == nil {
+					t.Errorf("Expected comparator mismatch error (stream=%v)", stream)
+				}
+			} else if err != nil {
+				t.Errorf("Unexpected error for comparator %q (stream=%v): %v", name, stream, err)
+			} else {
+				if c := snap2.Count(); c != 100 {
+					t.Errorf("Expected 100 items, got %d", c)
+				}
+				snap2.Close()
+			}
+			db2.Close()
+		}
+	}
+}
+
+func TestLoadLegacyFile(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	path := "legacy.dump"
+	defer os.Remove(path)
+	var bs []byte
+	for i := 0; i < 10; i++ {
+		itm := []byte(fmt.Sprintf("%010d", i))
+		bs = append(bs, 0, byte(len(itm)))
+		bs = append(bs, itm...)
+	}
+	bs = append(bs, 0, 0)
+	if err := ioutil.WriteFile(path, bs, 0660); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := db.NewFileReader(RawdbFile)
+	if err := r.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for i := 0; ; i++ {
+		itm, err := r.ReadItem()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if itm == nil {
+			if i != 10 {
+				t.Errorf("Expected 10 items, got %d", i)
+			}
+			break
+		}
+
+		if string(itm.Bytes()) != fmt.Sprintf("%010d", i) {
+			t.Errorf("Unexpected item %s", itm.Bytes())
+		}
+		db.freeItem(itm)
+	}
+}
+
+func TestUpgradeBackup(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	// Backup directory written by a version without the manifest
+	datadir := filepath.Join("db.dump", "data")
+	os.MkdirAll(datadir, 0755)
+	files := []string{"shard-0", "shard-1"}
+	for s, file := range files {
+		var bs []byte
+		for i := s * 10; i < (s+1)*10; i++ {
+			itm := []byte(fmt.Sprintf("%010d", i))
+			bs = append(bs, 0, byte(len(itm)))
+			bs = append(bs, itm...)
+		}
+		bs = append(bs, 0, 0)
+		ioutil.WriteFile(filepath.Join(datadir, file), bs, 0660)
+	}
+	bs, _ := json.Marshal(files)
+	ioutil.WriteFile(filepath.Join(datadir, "files.json"), bs, 0660)
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+	if _, err := db.LoadFromDisk("db.dump", 2, nil); err != ErrInvalidBackup {
+		t.Errorf("Expected invalid backup error, got %v", err)
+	}
+
+	// A truncated file should fail the upgrade
+	path := filepath.Join(datadir, "shard-1")
+	bs, _ = ioutil.ReadFile(path)
+	ioutil.WriteFile(path, bs[:len(bs)-5], 0660)
+	if err := UpgradeBackup("db.dump", testConf); err == nil {
+		t.Errorf("Expected an error for truncated file")
+	}
+	if _, err := os.Stat(filepath.Join("db.dump", manifestFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected no manifest after a failed upgrade")
+	}
+
+	ioutil.WriteFile(path, bs, 0660)
+	for i := 0; i < 2; i++ {
+		if err := UpgradeBackup("db.dump", testConf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snap, err := db.LoadFromDisk("db.dump", 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+
+	i := 0
+	itr := snap.NewIterator()
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if string(itr.Get()) != fmt.Sprintf("%010d", i) {
+			t.Errorf("Unexpected item %s", itr.Get())
+		}
+		i++
+	}
+
+	if i != 20 || snap.Count() != 20 {
+		t.Errorf("Expected 20 items, got %d (count %d)", i, snap.Count())
+	}
+
+	if err := UpgradeBackup("missing.dump", testConf); err != ErrInvalidBackup {
+		t.Errorf("Expected invalid backup error, got %v", err)
+	}
+}
+
+func TestLoadCorruptedFile(t *testing.T) {
+	var wg sync.WaitGroup
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	n := 100000
+	wg.Add(1)
+	go doInsert(db, &wg, n, false, true)
+	wg.Wait()
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+	if err := db.StoreToDisk("db.dump", snap, 8, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join("db.dump", "data", "shard-0")
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs[len(bs)/2]++
+	if err := ioutil.WriteFile(path, bs, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	_, err = db2.LoadFromDisk("db.dump", 8, nil)
+	if _, ok := err.(*CorruptionError); !ok {
+		t.Errorf("Expected corruption error, got %v", err)
+	}
+}
+
+func TestReadTruncatedFile(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	path := "truncated.dump"
+	defer os.Remove(path)
+
+	w, _ := db.NewFileWriter(RawdbFile)
+	if err := w.Open(path); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		itm := db.newItem([]byte(fmt.Sprintf("%010d", i)), false)
+		if err := w.WriteItem(itm); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, _ := os.Stat(path)
+	os.Truncate(path, fi.Size()-fileFooterSize)
+
+	r, _ := db.NewFileReader(RawdbFile)
+	if err := r.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	count := 0
+	for {
+		itm, err := r.ReadItem()
+		if err != nil {
+			if _, ok := err.(*CorruptionError); !ok {
+				t.Errorf("Expected corruption error, got %v", err)
+			}
+			break
+		}
+
+		if itm == nil {
+			t.Errorf("Expected an error for truncated file")
+			break
+		}
+		count++
+	}
+
+	if count != 1000 {
+		t.Errorf("Expected 1000 items, got %d", count)
+	}
+}
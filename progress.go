@@ -0,0 +1,260 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultProgressInterval - number of items of a shard between progress reports
+const DefaultProgressInterval = 10000
+
+// BackupProgress describes the progress of a disk backup or restore
+type BackupProgress struct {
+	// Shard file which made the progress and its items and bytes so far
+	Shard      int
+	ShardItems int64
+	ShardBytes int64
+	ShardDone  bool
+
+	// Items and bytes processed across all the shards
+	Items int64
+	Bytes int64
+
+	// Estimated total number of items. It is the ItemsCount() of the
+	// instance for a backup and the item count of the backup manifest for
+	// a restore. It is zero for an incremental backup.
+	EstimatedItems int64
+}
+
+// BackupOptions specifies the number of shard files, progress reporting and
+// throttling of the data files for StoreToDiskWithOptions,
+// StoreIncrementalToDiskWithOptions and LoadFromDiskWithOptions.
+// The bytes are counted as the item bytes read or written. Hence, the
+// actual disk I/O may differ for the compressed file types.
+type BackupOptions struct {
+	// Shards is the number of data files written by a backup. The items
+	// are range partitioned into shards having similar item bytes.
+	// Defaults to runtime.NumCPU(). A backup can be restored using any
+	// concurrency irrespective of the number of shards.
+	Shards int
+
+	// Progress is called after every ProgressInterval items of a shard and
+	// once a shard is completed. The calls are serialized.
+	Progress         func(BackupProgress)
+	ProgressInterval int64
+
+	// MaxBytesPerSec limits the rate of the item bytes across all the
+	// shards. Zero means no limit.
+	MaxBytesPerSec int64
+
+	// VerifyChecksums makes a restore verify the checksums of all the
+	// backup files in the manifest before the items are loaded. The rawdb
+	// files are verified by their block checksums while they are read
+	// anyway, so this is mostly useful for the custom file types.
+	VerifyChecksums bool
+}
+
+func (o *BackupOptions) enabled() bool {
+	return o.Progress != nil || o.MaxBytesPerSec > 0
+}
+
+// backupTracker aggregates the progress of the shards and throttles them
+type backupTracker struct {
+	sync.Mutex
+	ctx       context.Context
+	opts      BackupOptions
+	estimated int64
+	items     int64
+	bytes     int64
+	shards    []*shardProgress
+
+	start time.Time
+	// Bytes accounted by the rate limiter
+	limited int64
+}
+
+func newBackupTracker(ctx context.Context, opts BackupOptions, estimated int64) *backupTracker {
+	if !opts.enabled() {
+		return nil
+	}
+
+	if opts.ProgressInterval <= 0 {
+		opts.ProgressInterval = DefaultProgressInterval
+	}
+
+	return &backupTracker{
+		ctx:       ctx,
+		opts:      opts,
+		estimated: estimated,
+		start:     time.Now(),
+	}
+}
+
+func (t *backupTracker) report(s *shardProgress, done bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.items += s.items - s.reportedItems
+	t.bytes += s.bytes - s.reportedBytes
+	s.reportedItems = s.items
+	s.reportedBytes = s.bytes
+
+	if t.opts.Progress != nil {
+		t.opts.Progress(BackupProgress{
+			Shard:          s.shard,
+			ShardItems:     s.items,
+			ShardBytes:     s.bytes,
+			ShardDone:      done,
+			Items:          t.items,
+			Bytes:          t.bytes,
+			EstimatedItems: t.estimated,
+		})
+	}
+}
+
+// throttle blocks until the bytes processed so far are within the rate
+// limit. The wait is cut short if the context is cancelled and the caller
+// is expected to check the context.
+func (t *backupTracker) throttle(n int) {
+	if t.opts.MaxBytesPerSec <= 0 {
+		return
+	}
+
+	t.Lock()
+	t.limited += int64(n)
+	secs := float64(t.limited) / float64(t.opts.MaxBytesPerSec)
+	due := t.start.Add(time.Duration(secs * float64(time.Second)))
+	t.Unlock()
+
+	// Short waits are accumulated to avoid sleeping for every item
+	if d := due.Sub(time.Now()); d > time.Millisecond {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+		}
+	}
+}
+
+type shardProgress struct {
+	t     *backupTracker
+	shard int
+	items int64
+	bytes int64
+	done  bool
+
+	reportedItems int64
+	reportedBytes int64
+}
+
+func (s *shardProgress) add(itm *Item) {
+	n := len(itm.Bytes())
+	s.items++
+	s.bytes += int64(n)
+	if s.items-s.reportedItems >= s.t.opts.ProgressInterval {
+		s.t.report(s, false)
+	}
+
+	s.t.throttle(n)
+}
+
+func (s *shardProgress) finish() {
+	if !s.done {
+		s.done = true
+		s.t.report(s, true)
+	}
+}
+
+// newShard returns the progress of a shard which is not tracked by a file
+// writer
+func (t *backupTracker) newShard(shard int) *shardProgress {
+	if t == nil {
+		return nil
+	}
+
+	s := &shardProgress{t: t, shard: shard}
+	t.shards = append(t.shards, s)
+	return s
+}
+
+type trackedFileWriter struct {
+	FileWriter
+	shardProgress
+}
+
+func (t *backupTracker) wrapWriter(shard int, w FileWriter) FileWriter {
+	if t == nil {
+		return w
+	}
+
+	tw := &trackedFileWriter{
+		FileWriter:    w,
+		shardProgress: shardProgress{t: t, shard: shard},
+	}
+
+	t.shards = append(t.shards, &tw.shardProgress)
+	return tw
+}
+
+func (w *trackedFileWriter) WriteItem(itm *Item) error {
+	if err := w.FileWriter.WriteItem(itm); err != nil {
+		return err
+	}
+
+	w.add(itm)
+	return nil
+}
+
+// finish reports the completion of the shards written using the tracker
+func (t *backupTracker) finish() {
+	if t == nil {
+		return
+	}
+
+	for _, s := range t.shards {
+		s.finish()
+	}
+}
+
+type trackedFileReader struct {
+	FileReader
+	shardProgress
+}
+
+func (t *backupTracker) wrapReader(shard int, r FileReader) FileReader {
+	if t == nil {
+		return r
+	}
+
+	return &trackedFileReader{
+		FileReader:    r,
+		shardProgress: shardProgress{t: t, shard: shard},
+	}
+}
+
+func (r *trackedFileReader) ReadItem() (*Item, error) {
+	itm, err := r.FileReader.ReadItem()
+	if err != nil {
+		return nil, err
+	}
+
+	if itm == nil {
+		r.finish()
+		return nil, nil
+	}
+
+	r.add(itm)
+	return itm, nil
+}
@@ -18,8 +18,16 @@ import (
 var (
 	minItem unsafe.Pointer
 	maxItem = unsafe.Pointer(^uintptr(0))
+
+	// lastItem compares greater than all the items except maxItem
+	// using lastItemCmp
+	lastItem = unsafe.Pointer(new(byte))
 )
 
+func lastItemCmp(this, that unsafe.Pointer) int {
+	return -1
+}
+
 func compare(cmp CompareFn, this, that unsafe.Pointer) int {
 	if this == minItem || that == maxItem {
 		return -1
@@ -127,6 +127,49 @@ retry:
 	}
 }
 
+// Prev moves iterator to the previous item
+// The iterator becomes invalid when it moves before the first item.
+func (it *Iterator) Prev() {
+	if it.curr == it.s.tail {
+		it.SeekLast()
+		return
+	}
+
+	it.s.findPath(it.curr.Item(), it.cmp, it.buf, &it.s.Stats)
+	it.moveBackward(it.buf.preds[0])
+}
+
+// SeekLast moves cursor to the last item
+func (it *Iterator) SeekLast() {
+	it.s.findPath(lastItem, lastItemCmp, it.buf, &it.s.Stats)
+	it.moveBackward(it.buf.preds[0])
+}
+
+// SeekForPrev moves iterator to a provided item or the previous smaller item
+// if the item does not exist
+func (it *Iterator) SeekForPrev(itm unsafe.Pointer) bool {
+	found := it.s.findPath(itm, it.cmp, it.buf, &it.s.Stats) != nil
+	if found {
+		it.deleted = false
+		it.valid = true
+		it.prev = it.buf.preds[0]
+		it.curr = it.buf.succs[0]
+	} else {
+		it.moveBackward(it.buf.preds[0])
+	}
+
+	return found
+}
+
+func (it *Iterator) moveBackward(n *Node) {
+	// The predecessor of the node is not known. Next() can recover
+	// using a path search if it requires the predecessor.
+	it.deleted = false
+	it.prev = it.s.head
+	it.curr = n
+	it.valid = n != it.s.head
+}
+
 // Close is a destructor
 func (it *Iterator) Close() {
 	it.s.barrier.Release(it.bs)
@@ -133,8 +133,24 @@ func (s *Skiplist) FreeNode(n *Node, sts *Stats) {
 
 // ActionBuffer is a temporary buffer used by skiplist operations
 type ActionBuffer struct {
-	preds []*Node
-	succs []*Node
+	preds  []*Node
+	succs  []*Node
+	finger bool
+}
+
+// UseFinger enables finger search for the operations using the buffer.
+// The path search starts from the predecessors recorded by the previous
+// operation instead of the skiplist head. It reduces the cost of operations
+// on items in ascending order.
+// The caller should hold an access barrier session while finger search is
+// enabled since the recorded nodes should not be reclaimed.
+func (b *ActionBuffer) UseFinger(flag bool) {
+	if flag {
+		for i := range b.preds {
+			b.preds[i] = nil
+		}
+	}
+	b.finger = flag
 }
 
 // MakeBuf creates an action buffer
@@ -190,18 +206,32 @@ func (s *Skiplist) helpDelete(level int, prev, curr, next *Node, sts *Stats) boo
 func (s *Skiplist) findPath(itm unsafe.Pointer, cmp CompareFn,
 	buf *ActionBuffer, sts *Stats) (foundNode *Node) {
 	var cmpVal = 1
+	var curr *Node
+	useFinger := buf != nil && buf.finger
 
 retry:
 	prev := s.head
 	level := int(atomic.LoadInt32(&s.level))
 	for i := level; i >= 0; i-- {
-		curr, _ := prev.getNext(i)
+		// Resume from the previous predecessor if it is ahead in the level
+		if useFinger {
+			if finger := buf.preds[i]; finger != nil && finger != prev {
+				if _, deleted := finger.getNext(i); !deleted &&
+					compare(cmp, finger.Item(), itm) < 0 &&
+					compare(cmp, prev.Item(), finger.Item()) < 0 {
+					prev = finger
+				}
+			}
+		}
+
+		curr, _ = prev.getNext(i)
 	levelSearch:
 		for {
 			next, deleted := curr.getNext(i)
 			for deleted {
 				if !s.helpDelete(i, prev, curr, next, sts) {
 					sts.AddUint64(&sts.readConflicts, 1)
+					useFinger = false
 					goto retry
 				}
 
@@ -218,16 +248,40 @@ retry:
 			}
 		}
 
-		buf.preds[i] = prev
-		buf.succs[i] = curr
+		// A lookup without action buffer does not record the path
+		if buf != nil {
+			buf.preds[i] = prev
+			buf.succs[i] = curr
+		}
 	}
 
 	if cmpVal == 0 {
-		foundNode = buf.succs[0]
+		foundNode = curr
 	}
 	return
 }
 
+// Lookup returns the first node among the nodes with items equal to itm
+// (using cmp) for which filter returns true. Equal nodes are visited in
+// the list order. Unlike an iterator seek, it does not require an action
+// buffer.
+// Explicit barrier and release should be used by the caller before
+// and after this function call
+func (s *Skiplist) Lookup(itm unsafe.Pointer, cmp CompareFn,
+	filter func(unsafe.Pointer) bool, sts *Stats) *Node {
+	for n := s.findPath(itm, cmp, nil, sts); n != nil && n != s.tail; n, _ = n.getNext(0) {
+		if compare(cmp, n.Item(), itm) != 0 {
+			break
+		}
+
+		if filter == nil || filter(n.Item()) {
+			return n
+		}
+	}
+
+	return nil
+}
+
 // Insert adds an item into the skiplist
 func (s *Skiplist) Insert(itm unsafe.Pointer, cmp CompareFn,
 	buf *ActionBuffer, sts *Stats) (success bool) {
@@ -388,3 +442,62 @@ repeat:
 
 	return itms
 }
+
+// Number of sampled nodes per split range used for estimating item bytes
+const splitSamplesPerRange = 64
+
+// GetRangeSplitItemsBySize returns `nways` split range pivots such that
+// the ranges have similar item bytes. The item sizes are sampled from the
+// highest level having enough nodes. It falls back to GetRangeSplitItems()
+// if the item size function is not configured.
+// Explicit barrier and release should be used by the caller before
+// and after this function call
+func (s *Skiplist) GetRangeSplitItemsBySize(nways int) []unsafe.Pointer {
+	var deleted bool
+	if nways < 2 {
+		return nil
+	}
+
+repeat:
+	var itms, samples []unsafe.Pointer
+	var sizes []int64
+	var total int64
+
+	l := int(atomic.LoadInt32(&s.level))
+	for ; l > 0; l-- {
+		c := int(atomic.LoadInt64(&s.Stats.levelNodesCount[l]))
+		if c >= nways*splitSamplesPerRange {
+			break
+		}
+	}
+
+	node, deleted := s.head.getNext(l)
+	for node != s.tail {
+		if deleted {
+			goto repeat
+		}
+
+		sz := int64(s.ItemSize(node.Item()))
+		samples = append(samples, node.Item())
+		sizes = append(sizes, sz)
+		total += sz
+		node, deleted = node.getNext(l)
+	}
+
+	if total == 0 {
+		return s.GetRangeSplitItems(nways)
+	}
+
+	var sum int64
+	for i, itm := range samples {
+		if sum >= total*int64(len(itms)+1)/int64(nways) {
+			itms = append(itms, itm)
+			if len(itms) == nways-1 {
+				break
+			}
+		}
+		sum += sizes[i]
+	}
+
+	return itms
+}
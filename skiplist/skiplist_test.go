@@ -147,6 +147,58 @@ func TestGetRangeSplitItems(t *testing.T) {
 	fmt.Println("No of items in each range", diff)
 }
 
+func TestGetRangeSplitItemsBySize(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SetItemSizeFunc(func(itm unsafe.Pointer) int {
+		return (*byteKeyItem)(itm).Size()
+	})
+
+	sl := NewWithConfig(cfg)
+	buf := sl.MakeBuf()
+	defer sl.FreeBuf(buf)
+
+	// The items in the second half are larger
+	n := 100000
+	var total int
+	for i := 0; i < n; i++ {
+		k := fmt.Sprintf("%010d", i)
+		if i >= n/2 {
+			k += string(make([]byte, 90))
+		}
+		total += len(k)
+		sl.Insert(NewByteKeyItem([]byte(k)), CompareBytes, buf, &sl.Stats)
+	}
+
+	nways := 8
+	pivots := sl.GetRangeSplitItemsBySize(nways)
+	if len(pivots) != nways-1 {
+		t.Fatalf("Expected %d pivots, got %d", nways-1, len(pivots))
+	}
+
+	var sizes []int
+	var curr int
+	itr := sl.NewIterator(CompareBytes, buf)
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if len(pivots) > 0 && CompareBytes(itr.Get(), pivots[0]) == 0 {
+			sizes = append(sizes, curr)
+			curr = 0
+			pivots = pivots[1:]
+		}
+		curr += (*byteKeyItem)(itr.Get()).Size()
+	}
+	sizes = append(sizes, curr)
+
+	fmt.Println("Bytes in each range", sizes)
+	avg := total / nways
+	for _, sz := range sizes {
+		if sz < avg/2 || sz > avg*3/2 {
+			t.Errorf("Expected about %d bytes in each range, got %v", avg, sizes)
+			break
+		}
+	}
+}
+
 func TestBuilder(t *testing.T) {
 	var wg sync.WaitGroup
 
@@ -196,3 +248,48 @@ func TestBuilder(t *testing.T) {
 	}
 
 }
+
+func TestReverseIterator(t *testing.T) {
+	s := New()
+	cmp := CompareBytes
+	buf := s.MakeBuf()
+	defer s.FreeBuf(buf)
+
+	itr := s.NewIterator(cmp, buf)
+	defer itr.Close()
+	if itr.SeekLast(); itr.Valid() {
+		t.Errorf("Expected empty skiplist iterator to be invalid")
+	}
+
+	for i := 0; i < 2000; i += 2 {
+		s.Insert(NewByteKeyItem([]byte(fmt.Sprintf("%010d", i))), cmp, buf, &s.Stats)
+	}
+
+	count := 0
+	for itr.SeekLast(); itr.Valid(); itr.Prev() {
+		expected := fmt.Sprintf("%010d", 1998-count*2)
+		got := string(*(*byteKeyItem)(itr.Get()))
+		count++
+		if got != expected {
+			t.Errorf("Expected %s, got %v", expected, got)
+		}
+	}
+
+	if count != 1000 {
+		t.Errorf("Expected count = 1000, got %v", count)
+	}
+
+	if itr.Next(); !itr.Valid() || string(*(*byteKeyItem)(itr.Get())) != fmt.Sprintf("%010d", 0) {
+		t.Errorf("Expected Next() to move to the first item")
+	}
+
+	if found := itr.SeekForPrev(NewByteKeyItem([]byte(fmt.Sprintf("%010d", 1001)))); found ||
+		string(*(*byteKeyItem)(itr.Get())) != fmt.Sprintf("%010d", 1000) {
+		t.Errorf("Expected SeekForPrev() to move to the previous item")
+	}
+
+	if found := itr.SeekForPrev(NewByteKeyItem([]byte(fmt.Sprintf("%010d", 1000)))); !found ||
+		string(*(*byteKeyItem)(itr.Get())) != fmt.Sprintf("%010d", 1000) {
+		t.Errorf("Expected SeekForPrev() to find the item")
+	}
+}
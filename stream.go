@@ -0,0 +1,338 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"unsafe"
+
+	"github.com/t3rm1n4l/nitro/skiplist"
+)
+
+// Backup stream format:
+//
+// Header:  [8 byte magic][4 byte version][4 byte len][header json][4 byte crc32c]
+// Section: [1 byte type][rawdb v3 blocks][rawdb v3 footer]
+// Trailer: [1 byte type][8 byte item count][4 byte sections][4 byte crc32c]
+//
+// The sections are range partitions of the snapshot in the key order. A
+// section is a rawdb file without the file header. The block size and the
+// key comparator are described by the stream header.
+
+const (
+	streamVersion = 1
+	streamPath    = "<stream>"
+
+	streamSectionData byte = 1
+	streamSectionEnd  byte = 0
+
+	streamTrailerSize  = 16
+	maxStreamHeaderLen = 64 * 1024
+)
+
+var streamMagic = []byte("\x00\x00NITROS")
+
+// StreamSectionSize - item bytes after which StoreToStream starts a new section
+var StreamSectionSize int64 = 64 * 1024 * 1024
+
+type streamHeader struct {
+	Sn         uint32
+	SnGen      uint32 `json:",omitempty"`
+	KeyCompare string `json:",omitempty"`
+	BlockSize  int
+}
+
+// StoreToStream writes a Nitro snapshot to w as a single archive which can be
+// restored using LoadFromStream. The archive does not need a local directory
+// and hence it can be written to a network connection.
+// The items are written in the key order from the calling goroutine. The
+// snapshot is kept open until the archive is written and it is closed after
+// the backup. The write ahead log is not truncated.
+// The archive always uses the rawdb block format. The blocks are compressed
+// if the file type is CompressedFile and the other file types registered
+// using RegisterFileType are not used for the archive.
+func (m *Nitro) StoreToStream(w io.Writer, snap *Snapshot) error {
+	defer snap.Close()
+
+	if m.useMemoryMgmt {
+		m.shutdownWg1.Add(1)
+		defer m.shutdownWg1.Done()
+	}
+
+	if m.hasShutdown {
+		return ErrShutdown
+	}
+
+	bw := bufio.NewWriterSize(w, DiskBlockSize)
+	if err := m.writeStreamHeader(bw, snap); err != nil {
+		return err
+	}
+
+	var count uint64
+	var sections uint32
+	var sw *rawFileWriter
+	var size int64
+
+	closeSection := func() error {
+		if err := sw.finish(); err != nil {
+			return err
+		}
+
+		count += sw.count
+		sw = nil
+		size = 0
+		return nil
+	}
+
+	itr := m.NewIterator(snap)
+	if itr == nil {
+		return ErrShutdown
+	}
+	defer itr.Close()
+
+	itr.SetRefreshRate(m.refreshRate)
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if m.hasShutdown {
+			return ErrShutdown
+		}
+
+		if sw == nil {
+			if err := bw.WriteByte(streamSectionData); err != nil {
+				return err
+			}
+
+			sw = &rawFileWriter{db: m, compress: m.fileType == CompressedFile}
+			sw.init(bw)
+			sections++
+		}
+
+		itm := (*Item)(itr.GetNode().Item())
+		if err := sw.WriteItem(itm); err != nil {
+			return err
+		}
+
+		size += int64(itm.dataLen)
+		if size >= StreamSectionSize {
+			if err := closeSection(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if sw != nil {
+		if err := closeSection(); err != nil {
+			return err
+		}
+	}
+
+	trailer := make([]byte, streamTrailerSize+1)
+	trailer[0] = streamSectionEnd
+	binary.BigEndian.PutUint64(trailer[1:9], count)
+	binary.BigEndian.PutUint32(trailer[9:13], sections)
+	binary.BigEndian.PutUint32(trailer[13:], crc32.Checksum(trailer[1:13], crcTable))
+	if _, err := bw.Write(trailer); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+func (m *Nitro) writeStreamHeader(w io.Writer, snap *Snapshot) error {
+	bs, err := json.Marshal(&streamHeader{
+		Sn:         snap.sn,
+		SnGen:      snap.snGen,
+		KeyCompare: m.keyCmpName,
+		BlockSize:  DiskBlockSize,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	hdr := make([]byte, 0, len(streamMagic)+8+len(bs)+4)
+	hdr = append(hdr, streamMagic...)
+	hdr = append(hdr, make([]byte, 8)...)
+	binary.BigEndian.PutUint32(hdr[len(streamMagic):], streamVersion)
+	binary.BigEndian.PutUint32(hdr[len(streamMagic)+4:], uint32(len(bs)))
+	hdr = append(hdr, bs...)
+	hdr = append(hdr, make([]byte, 4)...)
+	l := len(hdr) - 4
+	binary.BigEndian.PutUint32(hdr[l:], crc32.Checksum(hdr[:l], crcTable))
+
+	_, err = w.Write(hdr)
+	return err
+}
+
+// LoadFromStream restores Nitro from an archive written by StoreToStream.
+// The snapshot numbers are resumed from the archived snapshot. If write ahead
+// logging is enabled, the log records newer than the archive are replayed.
+func (m *Nitro) LoadFromStream(r io.Reader) (*Snapshot, error) {
+	br := bufio.NewReaderSize(r, DiskBlockSize)
+	hdr, offset, err := m.readStreamHeader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	b := skiplist.NewBuilderWithConfig(m.newStoreConfig())
+	b.SetItemSizeFunc(ItemSize)
+
+	segments, err := m.readStreamSections(br, hdr, offset, b)
+	if err != nil {
+		m.discardStore(b.Assemble(segments...))
+		return nil, err
+	}
+
+	m.store = b.Assemble(segments...)
+	return m.finishRestore(hdr.SnGen, hdr.Sn)
+}
+
+func streamCorruption(offset int64, format string, args ...interface{}) error {
+	return &CorruptionError{Path: streamPath, Offset: offset, Reason: fmt.Sprintf(format, args...)}
+}
+
+// readStreamBytes reads exactly len(bs) bytes from the stream and reports
+// truncation as a corruption
+func readStreamBytes(r io.Reader, bs []byte, offset int64, what string) error {
+	_, err := io.ReadFull(r, bs)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return streamCorruption(offset, "truncated %s", what)
+	}
+
+	return err
+}
+
+func (m *Nitro) readStreamHeader(r io.Reader) (*streamHeader, int64, error) {
+	hdr := make([]byte, len(streamMagic)+8)
+	if err := readStreamBytes(r, hdr, 0, "stream header"); err != nil {
+		return nil, 0, err
+	}
+
+	if string(hdr[:len(streamMagic)]) != string(streamMagic) {
+		return nil, 0, ErrInvalidStream
+	}
+
+	if v := binary.BigEndian.Uint32(hdr[len(streamMagic):]); v != streamVersion {
+		return nil, 0, fmt.Errorf("Unsupported backup stream version %d", v)
+	}
+
+	l := int(binary.BigEndian.Uint32(hdr[len(streamMagic)+4:]))
+	if l > maxStreamHeaderLen {
+		return nil, 0, streamCorruption(int64(len(streamMagic)+4), "invalid stream header length %d", l)
+	}
+
+	hdr = append(hdr, make([]byte, l+4)...)
+	if err := readStreamBytes(r, hdr[len(streamMagic)+8:], int64(len(streamMagic)+8), "stream header"); err != nil {
+		return nil, 0, err
+	}
+
+	l = len(hdr) - 4
+	if crc32.Checksum(hdr[:l], crcTable) != binary.BigEndian.Uint32(hdr[l:]) {
+		return nil, 0, streamCorruption(0, "stream header checksum mismatch")
+	}
+
+	sh := new(streamHeader)
+	if err := json.Unmarshal(hdr[len(streamMagic)+8:l], sh); err != nil {
+		return nil, 0, streamCorruption(int64(len(streamMagic)+8), "invalid stream header: %v", err)
+	}
+
+	if sh.BlockSize <= 0 {
+		return nil, 0, streamCorruption(int64(len(streamMagic)+8), "invalid block size %d", sh.BlockSize)
+	}
+
+	if err := m.checkKeyCmpName(streamPath, sh.KeyCompare); err != nil {
+		return nil, 0, err
+	}
+
+	return sh, int64(len(hdr)), nil
+}
+
+// readStreamSections reads the sections into builder segments. The segments
+// read so far are returned on error.
+func (m *Nitro) readStreamSections(r *bufio.Reader, hdr *streamHeader, offset int64,
+	b *skiplist.Builder) ([]*skiplist.Segment, error) {
+
+	var segments []*skiplist.Segment
+	var count uint64
+	var sections uint32
+
+	for {
+		typ, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = streamCorruption(offset, "truncated section")
+			}
+			return segments, err
+		}
+
+		if typ == streamSectionEnd {
+			offset++
+			break
+		}
+
+		if typ != streamSectionData {
+			return segments, streamCorruption(offset, "invalid section type %d", typ)
+		}
+
+		seg := b.NewSegment()
+		segments = append(segments, seg)
+		sections++
+
+		sr := &rawFileReader{
+			db:        m,
+			r:         r,
+			path:      streamPath,
+			version:   rawdbFileV3,
+			blockSize: hdr.BlockSize,
+			offset:    offset + 1,
+			buf:       make([]byte, encodeBufSize),
+			blkHdr:    make([]byte, blockHeaderSize),
+			streamed:  true,
+		}
+
+		for {
+			itm, err := sr.ReadItem()
+			if err != nil {
+				return segments, err
+			}
+
+			if itm == nil {
+				break
+			}
+
+			seg.Add(unsafe.Pointer(itm))
+		}
+
+		count += sr.count
+		offset = sr.offset
+	}
+
+	trailer := make([]byte, streamTrailerSize)
+	if err := readStreamBytes(r, trailer, offset, "stream trailer"); err != nil {
+		return segments, err
+	}
+
+	if crc32.Checksum(trailer[:12], crcTable) != binary.BigEndian.Uint32(trailer[12:]) {
+		return segments, streamCorruption(offset, "stream trailer checksum mismatch")
+	}
+
+	c := binary.BigEndian.Uint64(trailer[:8])
+	n := binary.BigEndian.Uint32(trailer[8:12])
+	if c != count || n != sections {
+		return segments, streamCorruption(offset, "item count mismatch (trailer=%d/%d, read=%d/%d)",
+			c, n, count, sections)
+	}
+
+	return segments, nil
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import "bytes"
+import "fmt"
+import "io"
+import "testing"
+
+func TestStreamBackup(t *testing.T) {
+	defer func(v int64) {
+		StreamSectionSize = v
+	}(StreamSectionSize)
+	StreamSectionSize = 100000
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	n := 100000
+	expected := make(map[string]bool)
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		k := fmt.Sprintf("%010d", i)
+		w.Put([]byte(k))
+		expected[k] = true
+	}
+	for i := 0; i < 10; i++ {
+		snap, _ := w.NewSnapshot()
+		snap.Close()
+	}
+	snap, _ := w.NewSnapshot()
+	snap.Open()
+
+	// Changes after the snapshot should not be archived
+	for i := 0; i < n; i += 2 {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+
+	// Stream through a pipe to a restoring instance
+	r, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(db.StoreToStream(pw, snap))
+	}()
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	snap2, err := db2.LoadFromStream(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkItems(t, snap2, expected)
+	if snap2.Count() != int64(n) {
+		t.Errorf("Expected count %d, got %d", n, snap2.Count())
+	}
+
+	if snap2.sn != snap.sn {
+		t.Errorf("Expected snapshot number %d, got %d", snap.sn, snap2.sn)
+	}
+	snap2.Close()
+
+	var buf bytes.Buffer
+	if err := db.StoreToStream(&buf, snap); err != nil {
+		t.Fatal(err)
+	}
+	bs := buf.Bytes()
+
+	// Corrupted block
+	corrupted := append([]byte(nil), bs...)
+	corrupted[len(corrupted)/2]++
+	db3 := NewWithConfig(testConf)
+	defer db3.Close()
+	if _, err := db3.LoadFromStream(bytes.NewReader(corrupted)); err == nil {
+		t.Errorf("Expected an error for corrupted stream")
+	} else if _, ok := err.(*CorruptionError); !ok {
+		t.Errorf("Expected corruption error, got %v", err)
+	}
+
+	if c := db3.ItemsCount(); c != 0 {
+		t.Errorf("Expected partially restored items to be removed, got %d", c)
+	}
+
+	// Corrupted end of blocks marker of the last section
+	corrupted = append([]byte(nil), bs...)
+	corrupted[len(corrupted)-streamTrailerSize-1-fileFooterSize-1]++
+	db6 := NewWithConfig(testConf)
+	defer db6.Close()
+	if snap6, err := db6.LoadFromStream(bytes.NewReader(corrupted)); err == nil {
+		snap6.Close()
+		t.Errorf("Expected an error for corrupted end of blocks marker")
+	} else if _, ok := err.(*CorruptionError); !ok {
+		t.Errorf("Expected corruption error, got %v", err)
+	}
+
+	// Truncated stream
+	db4 := NewWithConfig(testConf)
+	defer db4.Close()
+	if _, err := db4.LoadFromStream(bytes.NewReader(bs[:len(bs)-1])); err == nil {
+		t.Errorf("Expected an error for truncated stream")
+	} else if _, ok := err.(*CorruptionError); !ok {
+		t.Errorf("Expected corruption error, got %v", err)
+	}
+
+	// Not a backup stream
+	db5 := NewWithConfig(testConf)
+	defer db5.Close()
+	if _, err := db5.LoadFromStream(bytes.NewReader(bs[20:])); err != ErrInvalidStream {
+		t.Errorf("Expected invalid stream error, got %v", err)
+	}
+}
+
+func TestStreamBackupEmpty(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	var buf bytes.Buffer
+	snap, _ := db.NewSnapshot()
+	if err := db.StoreToStream(&buf, snap); err != nil {
+		t.Fatal(err)
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	snap2, err := db2.LoadFromStream(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap2.Close()
+
+	if snap2.Count() != 0 {
+		t.Errorf("Expected no items, got %d", snap2.Count())
+	}
+}
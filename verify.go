@@ -0,0 +1,229 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// BackupProblem describes a problem found in a backup directory
+type BackupProblem struct {
+	// File relative to the backup directory
+	File   string
+	Offset int64
+	Reason string
+}
+
+func (p BackupProblem) String() string {
+	return fmt.Sprintf("%s at offset %d: %s", p.File, p.Offset, p.Reason)
+}
+
+// BackupFileInfo describes a backup file read by VerifyBackup
+type BackupFileInfo struct {
+	// File relative to the backup directory
+	File  string
+	Items int64
+}
+
+// VerifyResult describes a backup directory checked by VerifyBackup
+type VerifyResult struct {
+	Sn       uint32
+	BaseSn   uint32
+	FileType string
+
+	// ItemsCount is the number of items recorded in the manifest and Items
+	// is the number of items read from the data and tombstone files
+	ItemsCount int64
+	Items      int64
+	// Number of items read from the delta files
+	DeltaItems int64
+
+	Files    []BackupFileInfo
+	Problems []BackupProblem
+}
+
+// Valid returns true if no problems were found in the backup
+func (r *VerifyResult) Valid() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *VerifyResult) addProblem(file string, offset int64, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, BackupProblem{
+		File:   file,
+		Offset: offset,
+		Reason: fmt.Sprintf(format, args...),
+	})
+}
+
+// VerifyBackup checks a backup directory without restoring it. The checksums
+// of the files are verified and the data, tombstone and delta files are read
+// using the FileReader of the backup file type. The items of a shard should be
+// in the order of the configured key comparator and the shards should not
+// overlap. The problems found are reported in the result. An error is
+// returned only if the directory could not be verified.
+func VerifyBackup(dir string, cfg Config) (*VerifyResult, error) {
+	res := new(VerifyResult)
+	man, err := parseManifest(dir)
+	if err != nil {
+		if _, ok := err.(*CorruptionError); ok {
+			res.addProblem(manifestFile, 0, "invalid manifest")
+			return res, nil
+		}
+		return nil, err
+	}
+
+	t, err := lookupFileTypeByName(man.FileType)
+	if err != nil {
+		return nil, err
+	}
+
+	res.Sn = man.Sn
+	res.BaseSn = man.BaseSn
+	res.FileType = man.FileType
+	res.ItemsCount = man.ItemsCount
+
+	// The instance is used only for decoding the items
+	cfg.walDir = ""
+	m := NewWithConfig(cfg)
+	defer m.Close()
+
+	v := &backupVerifier{m: m, dir: dir, t: t, res: res}
+	v.verifyChecksums(man)
+
+	res.Items = v.verifyShards("data", man.Files, false)
+	if man.BaseSn == 0 {
+		// Delta files are optional and the items are not ordered
+		if files, err := readFileList(filepath.Join(dir, "delta")); err == nil {
+			for _, file := range files {
+				res.DeltaItems += v.verifyFile(filepath.Join("delta", file), nil)
+			}
+		}
+	} else {
+		// Tombstones can have multiple versions of an item
+		res.Items += v.verifyShards("tombstones", man.Files, true)
+	}
+
+	if res.Items != man.ItemsCount {
+		res.addProblem(manifestFile, 0, "item count mismatch (manifest=%d, read=%d)",
+			man.ItemsCount, res.Items)
+	}
+
+	return res, nil
+}
+
+type backupVerifier struct {
+	m   *Nitro
+	dir string
+	t   FileType
+	res *VerifyResult
+}
+
+func (v *backupVerifier) verifyChecksums(man *backupManifest) {
+	for _, file := range man.checksumFiles() {
+		cs := man.Checksums[file]
+		got, err := checksumFile(filepath.Join(v.dir, filepath.FromSlash(file)), false)
+		if err != nil {
+			v.res.addProblem(file, got.Size, "%v", err)
+		} else if got.Size != cs.Size {
+			v.res.addProblem(file, got.Size, "file size mismatch (expected %d)", cs.Size)
+		} else if got.CRC != cs.CRC {
+			v.res.addProblem(file, 0, "file checksum mismatch")
+		}
+	}
+}
+
+// verifyShards reads the shard files of a directory and checks that the
+// items are ordered across the shards
+func (v *backupVerifier) verifyShards(dir string, files []string, dups bool) int64 {
+	var count int64
+	var last []byte
+	var lastFile string
+
+	for _, file := range files {
+		var first, prev []byte
+		var outOfOrder bool
+		var n int64
+
+		file = filepath.ToSlash(filepath.Join(dir, file))
+		count += v.verifyFile(file, func(bs []byte) {
+			n++
+			if first == nil {
+				first = append([]byte(nil), bs...)
+			} else if c := v.m.keyCmp(prev, bs); !outOfOrder && (c > 0 || (c == 0 && !dups)) {
+				outOfOrder = true
+				v.res.addProblem(file, 0, "item %d is not in the key order", n)
+			}
+			prev = append(prev[:0], bs...)
+		})
+
+		if first == nil {
+			continue
+		}
+
+		if last != nil && v.m.keyCmp(last, first) >= 0 {
+			v.res.addProblem(file, 0, "shard overlaps with %s", lastFile)
+		}
+
+		last = prev
+		lastFile = file
+	}
+
+	return count
+}
+
+// verifyFile reads all the items of a file. The callback is invoked with the
+// item bytes.
+func (v *backupVerifier) verifyFile(file string, callb func([]byte)) int64 {
+	var count int64
+
+	file = filepath.ToSlash(file)
+	defer func() {
+		v.res.Files = append(v.res.Files, BackupFileInfo{File: file, Items: count})
+	}()
+
+	r, err := v.m.NewFileReader(v.t)
+	if err != nil {
+		v.res.addProblem(file, 0, "%v", err)
+		return count
+	}
+
+	if err := r.Open(filepath.Join(v.dir, filepath.FromSlash(file))); err != nil {
+		v.addReadProblem(file, err)
+		return count
+	}
+	defer r.Close()
+
+	for {
+		itm, err := r.ReadItem()
+		if err != nil {
+			v.addReadProblem(file, err)
+			return count
+		}
+
+		if itm == nil {
+			return count
+		}
+
+		count++
+		if callb != nil {
+			callb(itm.Bytes())
+		}
+		v.m.freeItem(itm)
+	}
+}
+
+func (v *backupVerifier) addReadProblem(file string, err error) {
+	if ce, ok := err.(*CorruptionError); ok {
+		v.res.addProblem(file, ce.Offset, "%s", ce.Reason)
+	} else {
+		v.res.addProblem(file, 0, "%v", err)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import "context"
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+
+func hasProblem(res *VerifyResult, file, reason string) bool {
+	for _, p := range res.Problems {
+		if p.File == file && strings.Contains(p.Reason, reason) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestVerifyBackup(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	n := 10000
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	opts := BackupOptions{Shards: 4}
+	if err := db.StoreToDiskWithOptions(context.Background(), "db.dump", snap, 4, nil, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := VerifyBackup("db.dump", testConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !res.Valid() {
+		t.Errorf("Unexpected problems %v", res.Problems)
+	}
+
+	if res.Items != int64(n) || res.ItemsCount != int64(n) || res.Sn != snap.sn {
+		t.Errorf("Unexpected result %+v", res)
+	}
+
+	var files int
+	for _, f := range res.Files {
+		if strings.HasPrefix(f.File, "data/") {
+			files++
+		}
+	}
+
+	if files != 4 {
+		t.Errorf("Expected 4 data files, got %v", res.Files)
+	}
+
+	// Shard having items out of order
+	path := filepath.Join("db.dump", "data", "shard-1")
+	fw := &rawFileWriter{db: db}
+	if err := fw.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"0000005001", "0000005000", "0000009999"} {
+		fw.WriteItem(db.newItem([]byte(k), false))
+	}
+	fw.Close()
+
+	// Manifest is rewritten with the checksums of the modified files
+	man, _ := parseManifest("db.dump")
+	os.Remove(filepath.Join("db.dump", manifestFile))
+	if err := writeManifest("db.dump", man, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = VerifyBackup("db.dump", testConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !hasProblem(res, "data/shard-1", "key order") ||
+		!hasProblem(res, "data/shard-2", "overlaps with data/shard-1") ||
+		!hasProblem(res, manifestFile, "item count mismatch") {
+		t.Errorf("Expected order, overlap and count problems, got %v", res.Problems)
+	}
+
+	// Corrupted shard
+	path = filepath.Join("db.dump", "data", "shard-0")
+	bs, _ := ioutil.ReadFile(path)
+	bs[len(bs)/2]++
+	ioutil.WriteFile(path, bs, 0755)
+
+	res, err = VerifyBackup("db.dump", testConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !hasProblem(res, "data/shard-0", "file checksum mismatch") ||
+		!hasProblem(res, "data/shard-0", "block checksum mismatch") {
+		t.Errorf("Expected checksum problems, got %v", res.Problems)
+	}
+
+	// Missing manifest
+	os.Remove(filepath.Join("db.dump", manifestFile))
+	if _, err := VerifyBackup("db.dump", testConf); err != ErrInvalidBackup {
+		t.Errorf("Expected invalid backup error, got %v", err)
+	}
+}
+
+func TestVerifyIncrementalBackup(t *testing.T) {
+	dirs := []string{"db.dump", "db.inc1"}
+	for _, dir := range dirs {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	w := db.NewWriter()
+	for i := 0; i < 10000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap1, _ := w.NewSnapshot()
+	snap1.Open()
+	if err := db.StoreToDisk(dirs[0], snap1, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Multiple versions of an item are deleted
+	for j := 0; j < 3; j++ {
+		for i := 0; i < 10000; i += 3 {
+			w.Delete([]byte(fmt.Sprintf("%010d", i)))
+			if j < 2 {
+				w.Put([]byte(fmt.Sprintf("%010d", i)))
+			}
+		}
+		snap, _ := w.NewSnapshot()
+		snap.Close()
+	}
+
+	snap2, _ := w.NewSnapshot()
+	if err := db.StoreIncrementalToDisk(dirs[1], snap1.sn, snap2, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+	snap1.Close()
+
+	for _, dir := range dirs {
+		res, err := VerifyBackup(dir, testConf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !res.Valid() || res.Items != res.ItemsCount {
+			t.Errorf("Unexpected result for %s %+v", dir, res)
+		}
+	}
+}
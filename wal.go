@@ -0,0 +1,723 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WALSyncPolicy specifies when the write ahead log is flushed to the disk
+type WALSyncPolicy int
+
+const (
+	// WALSyncNone leaves flushing of the log to the operating system
+	WALSyncNone WALSyncPolicy = iota
+	// WALSyncInterval flushes the logs periodically
+	WALSyncInterval
+	// WALSyncAlways flushes the log before a writer operation returns. The
+	// records of a batch operation (PutBatch, DeleteBatch and DeleteRange)
+	// are flushed together. The log of a writer is flushed independently of
+	// the other writers.
+	WALSyncAlways
+)
+
+const (
+	walPut byte = iota + 1
+	walDelete
+	walUpsert
+	walEnd
+
+	walRecordHeaderSize = 9
+	walBufSize          = 64 * 1024
+	walSegmentExt       = ".wal"
+	walRebaseExt        = ".rebase"
+)
+
+// WALSegmentSize - log segment size after which a writer switches to a new segment
+var WALSegmentSize int64 = 64 * 1024 * 1024
+
+// Write ahead log record format:
+// [1 byte type][4 byte sn][4 byte len][item_bytes][4 byte crc32c]
+//
+// Each writer appends to its own log segment. The records of a writer
+// are ordered by sn. During recovery, the records from all the segments are
+// merged by sn and the records of a writer are applied in the log order.
+//
+// A segment is sealed with an end record when it is closed. Only the active
+// segment of a writer can have a torn record at the end due to a crash.
+// Hence, an invalid record is ignored only at the end of a segment which is
+// not sealed.
+//
+// When the snapshot numbers wrap around, the active segments are closed and
+// a marker file named with the next segment seqno and the new generation of
+// snapshot numbers is created. The segments following a marker belong to its
+// generation.
+
+type walSegment struct {
+	path  string
+	seqno uint64
+	gen   uint32
+	maxSn uint32
+}
+
+type walMarker struct {
+	path  string
+	seqno uint64
+	gen   uint32
+}
+
+type walManager struct {
+	sync.Mutex
+	dir      string
+	policy   WALSyncPolicy
+	nextSeg  uint64
+	gen      uint32
+	segments []*walSegment
+	markers  []*walMarker
+	logs     []*walLog
+	err      error
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+type walLog struct {
+	sync.Mutex
+	mgr  *walManager
+	seg  *walSegment
+	fd   *os.File
+	w    *bufio.Writer
+	size int64
+	hdr  []byte
+}
+
+type walRecord struct {
+	typ byte
+	gen uint32
+	sn  uint32
+	bs  []byte
+}
+
+func newWALManager(dir string, policy WALSyncPolicy, interval time.Duration) *walManager {
+	mgr := &walManager{
+		dir:    dir,
+		policy: policy,
+		stop:   make(chan struct{}),
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		mgr.err = err
+		return mgr
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+walSegmentExt))
+	if err != nil {
+		mgr.err = err
+		return mgr
+	}
+
+	for _, path := range paths {
+		var seqno uint64
+		if _, err := fmt.Sscanf(filepath.Base(path), "%d"+walSegmentExt, &seqno); err != nil {
+			continue
+		}
+
+		// Generation and max sn of the segment are known only after it is replayed
+		mgr.segments = append(mgr.segments, &walSegment{path: path, seqno: seqno,
+			gen: math.MaxUint32, maxSn: math.MaxUint32})
+		if seqno >= mgr.nextSeg {
+			mgr.nextSeg = seqno + 1
+		}
+	}
+
+	paths, err = filepath.Glob(filepath.Join(dir, "*"+walRebaseExt))
+	if err != nil {
+		mgr.err = err
+		return mgr
+	}
+
+	for _, path := range paths {
+		var seqno uint64
+		var gen uint32
+		if _, err := fmt.Sscanf(filepath.Base(path), "%d-%d"+walRebaseExt, &seqno, &gen); err != nil {
+			continue
+		}
+
+		mgr.markers = append(mgr.markers, &walMarker{path: path, seqno: seqno, gen: gen})
+		if seqno >= mgr.nextSeg {
+			mgr.nextSeg = seqno + 1
+		}
+	}
+
+	sort.Sort(walSegments(mgr.segments))
+	sort.Sort(walMarkers(mgr.markers))
+
+	if policy == WALSyncInterval && interval > 0 {
+		mgr.wg.Add(1)
+		go mgr.syncWorker(interval)
+	}
+
+	return mgr
+}
+
+type walSegments []*walSegment
+
+func (s walSegments) Len() int           { return len(s) }
+func (s walSegments) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s walSegments) Less(i, j int) bool { return s[i].seqno < s[j].seqno }
+
+type walMarkers []*walMarker
+
+func (s walMarkers) Len() int           { return len(s) }
+func (s walMarkers) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s walMarkers) Less(i, j int) bool { return s[i].seqno < s[j].seqno }
+
+func (mgr *walManager) setError(err error) {
+	mgr.Lock()
+	defer mgr.Unlock()
+	if mgr.err == nil {
+		mgr.err = err
+	}
+}
+
+func (mgr *walManager) getError() error {
+	mgr.Lock()
+	defer mgr.Unlock()
+	return mgr.err
+}
+
+func (mgr *walManager) newLog() *walLog {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	l := &walLog{mgr: mgr, hdr: make([]byte, walRecordHeaderSize)}
+	mgr.logs = append(mgr.logs, l)
+	return l
+}
+
+// closeLog closes the active segment of a log which is not used anymore
+func (mgr *walManager) closeLog(l *walLog) {
+	l.Lock()
+	if err := l.closeSegment(); err != nil {
+		mgr.setError(err)
+	}
+	l.Unlock()
+
+	mgr.Lock()
+	defer mgr.Unlock()
+	for i, x := range mgr.logs {
+		if x == l {
+			mgr.logs = append(mgr.logs[:i:i], mgr.logs[i+1:]...)
+			break
+		}
+	}
+}
+
+func (mgr *walManager) newSegment() *walSegment {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	seqno := mgr.nextSeg
+	mgr.nextSeg++
+	return &walSegment{
+		path:  filepath.Join(mgr.dir, fmt.Sprintf("%016d", seqno)+walSegmentExt),
+		seqno: seqno,
+		gen:   mgr.gen,
+	}
+}
+
+func (mgr *walManager) addSegment(seg *walSegment) {
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	mgr.segments = append(mgr.segments, seg)
+	sort.Sort(walSegments(mgr.segments))
+}
+
+func (mgr *walManager) syncWorker(interval time.Duration) {
+	defer mgr.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			mgr.Lock()
+			logs := mgr.logs
+			mgr.Unlock()
+
+			for _, l := range logs {
+				if err := l.sync(); err != nil {
+					mgr.setError(err)
+				}
+			}
+		case <-mgr.stop:
+			return
+		}
+	}
+}
+
+// truncate removes the log segments having records only up to the given sn.
+// The active segments of the writers are switched if they qualify.
+func (mgr *walManager) truncate(gen, sn uint32) error {
+	mgr.Lock()
+	logs := mgr.logs
+	mgr.Unlock()
+
+	covered := func(seg *walSegment) bool {
+		return seg.gen < gen || (seg.gen == gen && seg.maxSn <= sn)
+	}
+
+	for _, l := range logs {
+		l.Lock()
+		if l.seg != nil && covered(l.seg) {
+			if err := l.closeSegment(); err != nil {
+				l.Unlock()
+				return err
+			}
+		}
+		l.Unlock()
+	}
+
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	var segments []*walSegment
+	for _, seg := range mgr.segments {
+		if covered(seg) {
+			if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		} else {
+			segments = append(segments, seg)
+		}
+	}
+
+	mgr.segments = segments
+
+	// The segments of the older generations have been removed
+	var markers []*walMarker
+	for _, mk := range mgr.markers {
+		if mk.gen <= gen {
+			if err := os.Remove(mk.path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		} else {
+			markers = append(markers, mk)
+		}
+	}
+
+	mgr.markers = markers
+	return nil
+}
+
+// rebase closes the active segments and starts a new generation of
+// snapshot numbers. It is called while the writers are paused.
+func (mgr *walManager) rebase(gen uint32) {
+	mgr.Lock()
+	logs := mgr.logs
+	mgr.Unlock()
+
+	for _, l := range logs {
+		l.Lock()
+		if err := l.closeSegment(); err != nil {
+			mgr.setError(err)
+		}
+		l.Unlock()
+	}
+
+	mgr.Lock()
+	defer mgr.Unlock()
+
+	seqno := mgr.nextSeg
+	mgr.nextSeg++
+	mk := &walMarker{
+		path:  filepath.Join(mgr.dir, fmt.Sprintf("%016d-%d", seqno, gen)+walRebaseExt),
+		seqno: seqno,
+		gen:   gen,
+	}
+
+	fd, err := os.OpenFile(mk.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err == nil {
+		fd.Close()
+		err = syncDir(mgr.dir)
+	}
+
+	if err != nil && mgr.err == nil {
+		mgr.err = err
+	}
+
+	mgr.markers = append(mgr.markers, mk)
+	mgr.gen = gen
+}
+
+func (mgr *walManager) close() error {
+	close(mgr.stop)
+	mgr.wg.Wait()
+
+	mgr.Lock()
+	logs := mgr.logs
+	mgr.Unlock()
+
+	for _, l := range logs {
+		l.Lock()
+		if err := l.closeSegment(); err != nil {
+			mgr.setError(err)
+		}
+		l.Unlock()
+	}
+
+	return mgr.getError()
+}
+
+func (l *walLog) append(typ byte, sn uint32, bs []byte) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.fd == nil {
+		seg := l.mgr.newSegment()
+		fd, err := os.OpenFile(seg.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return err
+		}
+
+		l.seg = seg
+		l.fd = fd
+		l.size = 0
+		if l.w == nil {
+			l.w = bufio.NewWriterSize(fd, walBufSize)
+		} else {
+			l.w.Reset(fd)
+		}
+
+		// The synced records are lost if the segment is not durable
+		if err := syncDir(l.mgr.dir); err != nil {
+			return err
+		}
+	}
+
+	l.writeRecord(typ, sn, bs)
+	if sn > l.seg.maxSn {
+		l.seg.maxSn = sn
+	}
+
+	if l.size >= WALSegmentSize {
+		return l.closeSegment()
+	}
+
+	return nil
+}
+
+func (l *walLog) writeRecord(typ byte, sn uint32, bs []byte) {
+	l.hdr[0] = typ
+	binary.BigEndian.PutUint32(l.hdr[1:5], sn)
+	binary.BigEndian.PutUint32(l.hdr[5:9], uint32(len(bs)))
+	crc := crc32.Update(crc32.Checksum(l.hdr, crcTable), crcTable, bs)
+
+	l.w.Write(l.hdr)
+	l.w.Write(bs)
+	binary.Write(l.w, binary.BigEndian, crc)
+	l.size += int64(walRecordHeaderSize + len(bs) + 4)
+}
+
+func (l *walLog) flush() error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+
+	return l.fd.Sync()
+}
+
+func (l *walLog) sync() error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.fd == nil {
+		return nil
+	}
+
+	return l.flush()
+}
+
+// closeSegment seals, flushes and closes the active segment. The next record
+// is written to a new segment.
+func (l *walLog) closeSegment() error {
+	if l.fd == nil {
+		return nil
+	}
+
+	l.writeRecord(walEnd, 0, nil)
+	err := l.flush()
+	if e := l.fd.Close(); err == nil {
+		err = e
+	}
+
+	l.mgr.addSegment(l.seg)
+	l.fd = nil
+	l.seg = nil
+	return err
+}
+
+// readWALSegment reads the records of a log segment. A torn record at the
+// end of a segment which is not sealed is ignored. Otherwise, an invalid
+// record is reported as a corruption.
+func readWALSegment(seg *walSegment, callb func(walRecord)) error {
+	fd, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	fi, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := fi.Size()
+	sealed, err := isSealedWALSegment(fd, size)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	invalid := func(format string, args ...interface{}) error {
+		if !sealed {
+			return nil
+		}
+
+		return &CorruptionError{Path: seg.path, Offset: offset, Reason: fmt.Sprintf(format, args...)}
+	}
+
+	r := bufio.NewReaderSize(fd, walBufSize)
+	hdr := make([]byte, walRecordHeaderSize)
+	crcbuf := make([]byte, 4)
+	seg.maxSn = 0
+
+	for offset < size {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return invalid("truncated record header")
+		}
+
+		// The length is verified before allocating the buffer
+		l := int64(binary.BigEndian.Uint32(hdr[5:9]))
+		if l > size-offset-walRecordHeaderSize-4 {
+			return invalid("invalid record length %d", l)
+		}
+
+		bs := make([]byte, l)
+		if _, err := io.ReadFull(r, bs); err != nil {
+			return invalid("truncated record")
+		}
+
+		if _, err := io.ReadFull(r, crcbuf); err != nil {
+			return invalid("truncated record")
+		}
+
+		crc := crc32.Update(crc32.Checksum(hdr, crcTable), crcTable, bs)
+		if crc != binary.BigEndian.Uint32(crcbuf) {
+			return invalid("record checksum mismatch")
+		}
+
+		if hdr[0] == walEnd {
+			if offset+walRecordHeaderSize+l+4 != size {
+				return invalid("records after the end of segment")
+			}
+			return nil
+		}
+
+		rec := walRecord{typ: hdr[0], sn: binary.BigEndian.Uint32(hdr[1:5]), bs: bs}
+		if rec.sn > seg.maxSn {
+			seg.maxSn = rec.sn
+		}
+		callb(rec)
+		offset += walRecordHeaderSize + l + 4
+	}
+
+	return invalid("missing end of segment")
+}
+
+// isSealedWALSegment checks whether a segment ends with a valid end record
+func isSealedWALSegment(fd *os.File, size int64) (bool, error) {
+	l := int64(walRecordHeaderSize + 4)
+	if size < l {
+		return false, nil
+	}
+
+	rec := make([]byte, l)
+	if _, err := fd.ReadAt(rec, size-l); err != nil {
+		return false, err
+	}
+
+	crc := crc32.Checksum(rec[:walRecordHeaderSize], crcTable)
+	return rec[0] == walEnd && binary.BigEndian.Uint32(rec[5:9]) == 0 &&
+		crc == binary.BigEndian.Uint32(rec[walRecordHeaderSize:]), nil
+}
+
+type walRecords []walRecord
+
+func (r walRecords) Len() int      { return len(r) }
+func (r walRecords) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r walRecords) Less(i, j int) bool {
+	if r[i].gen != r[j].gen {
+		return r[i].gen < r[j].gen
+	}
+
+	return r[i].sn < r[j].sn
+}
+
+// replayWAL applies the log records newer than the given sn and resumes
+// the snapshot numbers from the latest record.
+func (m *Nitro) replayWAL(gen, sn uint32) error {
+	var records walRecords
+
+	mgr := m.wal
+	if err := mgr.getError(); err != nil {
+		return err
+	}
+
+	mgr.Lock()
+	segments := mgr.segments
+	markers := mgr.markers
+	mgr.Unlock()
+
+	// The segments before the first marker belong to the previous generation
+	// of the marker. Otherwise, they belong to the generation of the backup.
+	segGen := gen
+	if len(markers) > 0 {
+		segGen = markers[0].gen - 1
+	}
+
+	lastGen, maxSn := gen, sn
+	for _, seg := range segments {
+		for len(markers) > 0 && markers[0].seqno < seg.seqno {
+			segGen = markers[0].gen
+			markers = markers[1:]
+		}
+
+		seg.gen = segGen
+		if seg.gen > lastGen {
+			lastGen, maxSn = seg.gen, 1
+		}
+
+		err := readWALSegment(seg, func(rec walRecord) {
+			rec.gen = seg.gen
+			if rec.gen > gen || (rec.gen == gen && rec.sn > sn) {
+				records = append(records, rec)
+			}
+		})
+
+		if err != nil {
+			return err
+		}
+
+		if seg.gen == lastGen && seg.maxSn > maxSn {
+			maxSn = seg.maxSn
+		}
+	}
+
+	// A wrap around may not have been followed by any writes
+	for _, mk := range markers {
+		if mk.gen > lastGen {
+			lastGen, maxSn = mk.gen, 1
+		}
+	}
+
+	// Segments are read in the order of creation. Hence, the stable sort
+	// retains the order of records of a writer.
+	sort.Stable(records)
+	mgr.Lock()
+	mgr.gen = lastGen
+	mgr.Unlock()
+	m.restoreSn(lastGen, maxSn)
+
+	w := m.NewWriter()
+	w.walOff = true
+	defer w.Close()
+
+	for _, rec := range records {
+		switch rec.typ {
+		case walPut:
+			w.Put(rec.bs)
+		case walDelete:
+			w.Delete(rec.bs)
+		case walUpsert:
+			w.Upsert(rec.bs)
+		}
+	}
+
+	return nil
+}
+
+func (w *Writer) logWAL(typ byte, sn uint32, bs []byte) {
+	if w.wal == nil || w.walOff {
+		return
+	}
+
+	if w.walLog == nil {
+		w.walLog = w.wal.newLog()
+	}
+
+	if err := w.walLog.append(typ, sn, bs); err != nil {
+		w.wal.setError(err)
+	} else if w.wal.policy == WALSyncAlways {
+		// Synced by exitEpoch or at the end of a batch operation
+		w.walUnsynced = true
+	}
+}
+
+// beginWALBatch defers the log flush of WALSyncAlways until the end of a
+// batch operation
+func (w *Writer) beginWALBatch() {
+	w.walBatch++
+}
+
+func (w *Writer) endWALBatch() {
+	w.walBatch--
+	if w.walBatch == 0 && w.walUnsynced {
+		w.syncWAL()
+	}
+}
+
+func (w *Writer) syncWAL() {
+	w.walUnsynced = false
+	if err := w.walLog.sync(); err != nil {
+		w.wal.setError(err)
+	}
+}
+
+// WALError returns the first error encountered by the write ahead log
+func (m *Nitro) WALError() error {
+	if m.wal == nil {
+		return nil
+	}
+
+	return m.wal.getError()
+}
+
+// RecoverFromWAL restores Nitro from the write ahead log when there is no
+// disk backup available
+func (m *Nitro) RecoverFromWAL() (*Snapshot, error) {
+	if m.wal == nil {
+		return nil, ErrWALNotEnabled
+	}
+
+	return m.finishRestore(0, 0)
+}
@@ -0,0 +1,355 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "math"
+import "sync/atomic"
+import "testing"
+import "time"
+
+func walTestConf(policy WALSyncPolicy) Config {
+	conf := testConf
+	conf.UseWAL("db.wal", policy, time.Millisecond*10)
+	return conf
+}
+
+func checkItems(t *testing.T, snap *Snapshot, expected map[string]bool) {
+	count := 0
+	itr := snap.NewIterator()
+	defer itr.Close()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if !expected[string(itr.Get())] {
+			t.Errorf("Unexpected item %s", itr.Get())
+		}
+		count++
+	}
+
+	if count != len(expected) {
+		t.Errorf("Expected %d items, got %d", len(expected), count)
+	}
+}
+
+func TestWALRecovery(t *testing.T) {
+	os.RemoveAll("db.wal")
+	defer os.RemoveAll("db.wal")
+
+	conf := walTestConf(WALSyncAlways)
+	db := NewWithConfig(conf)
+	expected := make(map[string]bool)
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprintf("%010d", i)
+		w.Put([]byte(k))
+		expected[k] = true
+		if i%100 == 0 {
+			snap, _ := w.NewSnapshot()
+			snap.Close()
+		}
+	}
+
+	for i := 0; i < 1000; i += 2 {
+		k := fmt.Sprintf("%010d", i)
+		w.Delete([]byte(k))
+		delete(expected, k)
+	}
+
+	w.Upsert([]byte(fmt.Sprintf("%010d", 1001)))
+	expected[fmt.Sprintf("%010d", 1001)] = true
+	db.Close()
+
+	// A torn record at the end of the log should be ignored. The end
+	// record is removed to simulate a crash.
+	segs, _ := filepath.Glob(filepath.Join("db.wal", "*"+walSegmentExt))
+	if len(segs) == 0 {
+		t.Fatalf("Expected log segments")
+	}
+	path := segs[len(segs)-1]
+	fi, _ := os.Stat(path)
+	os.Truncate(path, fi.Size()-walRecordHeaderSize-4)
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{walPut, 0, 0})
+	f.Close()
+
+	db2 := NewWithConfig(conf)
+	defer db2.Close()
+	snap, err := db2.RecoverFromWAL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap.Close()
+
+	checkItems(t, snap, expected)
+	if snap.sn < 10 {
+		t.Errorf("Expected snapshot number to be resumed from the log, got %d", snap.sn)
+	}
+
+	// The writer used for the replay should be removed
+	w = db2.NewWriter()
+	snap2, _ := w.NewSnapshot()
+	snap2.Close()
+	if n := db2.numWriters(); n != 1 {
+		t.Errorf("Expected the replay writer to be removed, got %d writers", n)
+	}
+}
+
+func TestWALSyncBatch(t *testing.T) {
+	os.RemoveAll("db.wal")
+	defer os.RemoveAll("db.wal")
+
+	db := NewWithConfig(walTestConf(WALSyncAlways))
+	defer db.Close()
+
+	var items [][]byte
+	for i := 0; i < 1000; i++ {
+		items = append(items, []byte(fmt.Sprintf("%010d", i)))
+	}
+
+	// The records of a batch should be flushed when the batch returns
+	w := db.NewWriter()
+	w.PutBatch(items)
+	size := func() int64 {
+		segs, _ := filepath.Glob(filepath.Join("db.wal", "*"+walSegmentExt))
+		if len(segs) != 1 {
+			t.Fatalf("Expected a log segment, got %v", segs)
+		}
+		fi, _ := os.Stat(segs[0])
+		return fi.Size()
+	}
+
+	recSize := int64(walRecordHeaderSize + 10 + 4)
+	if sz := size(); sz != 1000*recSize {
+		t.Errorf("Expected %d bytes to be flushed, got %d", 1000*recSize, sz)
+	}
+
+	if n, _ := w.DeleteRange(nil, items[500]); n != 500 {
+		t.Errorf("Expected 500 items to be deleted, got %d", n)
+	}
+
+	if sz := size(); sz != 1500*recSize {
+		t.Errorf("Expected %d bytes to be flushed, got %d", 1500*recSize, sz)
+	}
+
+	// The single operations are flushed once they leave the epoch
+	w.Put([]byte(fmt.Sprintf("%010d", 2000)))
+	w.Delete(items[600])
+	w.Upsert(items[700])
+	if sz := size(); sz != 1503*recSize {
+		t.Errorf("Expected %d bytes to be flushed, got %d", 1503*recSize, sz)
+	}
+
+	if w.walUnsynced || atomic.LoadUint32(&w.activeSn) != 0 {
+		t.Errorf("Expected the log to be synced outside the epoch")
+	}
+}
+
+func TestWALCorruption(t *testing.T) {
+	os.RemoveAll("db.wal")
+	defer os.RemoveAll("db.wal")
+
+	conf := walTestConf(WALSyncNone)
+	db := NewWithConfig(conf)
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	db.Close()
+
+	segs, _ := filepath.Glob(filepath.Join("db.wal", "*"+walSegmentExt))
+	if len(segs) != 1 {
+		t.Fatalf("Expected a log segment, got %v", segs)
+	}
+	path := segs[0]
+	bs, _ := ioutil.ReadFile(path)
+	n := len(bs)
+	endRec := walRecordHeaderSize + 4
+
+	load := func(bs []byte) (int64, error) {
+		ioutil.WriteFile(path, bs, 0644)
+		db := NewWithConfig(conf)
+		defer db.Close()
+
+		snap, err := db.RecoverFromWAL()
+		if err != nil {
+			return 0, err
+		}
+		defer snap.Close()
+		return snap.Count(), nil
+	}
+
+	// Corrupted record of a sealed segment
+	corrupted := append([]byte(nil), bs...)
+	corrupted[n/2]++
+	if _, err := load(corrupted); err == nil {
+		t.Errorf("Expected an error for corrupted segment")
+	} else if _, ok := err.(*CorruptionError); !ok {
+		t.Errorf("Expected corruption error, got %v", err)
+	}
+
+	// Invalid record length of a sealed segment
+	corrupted = append([]byte(nil), bs...)
+	corrupted[5] = 0xff
+	if _, err := load(corrupted); err == nil {
+		t.Errorf("Expected an error for invalid record length")
+	} else if _, ok := err.(*CorruptionError); !ok {
+		t.Errorf("Expected corruption error, got %v", err)
+	}
+
+	// Torn record with an invalid length at the end of an active segment
+	rec := len(bs[:n-endRec]) / 1000
+	torn := append([]byte(nil), bs[:n-endRec-rec]...)
+	torn = append(torn, walPut, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff)
+	if c, err := load(torn); err != nil {
+		t.Errorf("Unexpected error for torn record: %v", err)
+	} else if c != 999 {
+		t.Errorf("Expected 999 items, got %d", c)
+	}
+}
+
+func TestWALBackupTruncate(t *testing.T) {
+	os.RemoveAll("db.wal")
+	defer os.RemoveAll("db.wal")
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	conf := walTestConf(WALSyncInterval)
+	db := NewWithConfig(conf)
+	expected := make(map[string]bool)
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprintf("%010d", i)
+		w.Put([]byte(k))
+		expected[k] = true
+	}
+
+	snap, _ := w.NewSnapshot()
+	if err := db.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if segs, _ := filepath.Glob(filepath.Join("db.wal", "*"+walSegmentExt)); len(segs) != 0 {
+		t.Errorf("Expected log segments to be truncated, got %v", segs)
+	}
+
+	for i := 0; i < 1000; i += 3 {
+		k := fmt.Sprintf("%010d", i)
+		w.Delete([]byte(k))
+		delete(expected, k)
+	}
+
+	for i := 1000; i < 1500; i++ {
+		k := fmt.Sprintf("%010d", i)
+		w.Put([]byte(k))
+		expected[k] = true
+	}
+
+	// Interval sync should flush the log without closing
+	time.Sleep(time.Millisecond * 100)
+	segs, _ := filepath.Glob(filepath.Join("db.wal", "*"+walSegmentExt))
+	if len(segs) != 1 {
+		t.Fatalf("Expected one log segment, got %v", segs)
+	}
+
+	if fi, _ := os.Stat(segs[0]); fi.Size() == 0 {
+		t.Errorf("Expected log segment to be flushed")
+	}
+	db.Close()
+
+	db2 := NewWithConfig(conf)
+	defer db2.Close()
+	snap2, err := db2.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap2.Close()
+
+	checkItems(t, snap2, expected)
+	if snap2.Count() != int64(len(expected)) {
+		t.Errorf("Expected count %d, got %d", len(expected), snap2.Count())
+	}
+}
+
+func TestWALSnWrap(t *testing.T) {
+	os.RemoveAll("db.wal")
+	defer os.RemoveAll("db.wal")
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+
+	conf := walTestConf(WALSyncAlways)
+	db := NewWithConfig(conf)
+	db.restoreSn(0, math.MaxUint32-10)
+	expected := make(map[string]bool)
+
+	w := db.NewWriter()
+	for i := 0; i < 1000; i++ {
+		k := fmt.Sprintf("%010d", i)
+		w.Put([]byte(k))
+		expected[k] = true
+		if i%50 == 0 {
+			snap, _ := w.NewSnapshot()
+			snap.Close()
+		}
+
+		// Items written before the wrap around should be replayed first
+		if i%3 == 0 && i > 500 {
+			k := fmt.Sprintf("%010d", i-500)
+			w.Delete([]byte(k))
+			delete(expected, k)
+		}
+	}
+
+	gen := db.getSnGen()
+	if gen == 0 {
+		t.Fatalf("Expected snapshot numbers to wrap around")
+	}
+	db.Close()
+
+	db2 := NewWithConfig(conf)
+	snap, err := db2.RecoverFromWAL()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkItems(t, snap, expected)
+	if db2.getSnGen() != gen {
+		t.Errorf("Expected generation %d, got %d", gen, db2.getSnGen())
+	}
+
+	if err := db2.StoreToDisk("db.dump", snap, 4, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if files, _ := filepath.Glob(filepath.Join("db.wal", "*")); len(files) != 0 {
+		t.Errorf("Expected log to be truncated, got %v", files)
+	}
+
+	w = db2.NewWriter()
+	for i := 1000; i < 1100; i++ {
+		k := fmt.Sprintf("%010d", i)
+		w.Put([]byte(k))
+		expected[k] = true
+	}
+	db2.Close()
+
+	db3 := NewWithConfig(conf)
+	defer db3.Close()
+	snap3, err := db3.LoadFromDisk("db.dump", 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snap3.Close()
+
+	checkItems(t, snap3, expected)
+}
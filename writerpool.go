@@ -0,0 +1,72 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package nitro
+
+import "sync"
+
+// WriterPool reuses Nitro writers for short lived tasks such as a request.
+// Each writer has its own garbage collection workers and NewSnapshot visits
+// all the writers. Hence, creating a writer per task is expensive.
+//
+// A writer obtained using Get() is owned by the caller until it is returned
+// using Put(). The idle writers in excess of maxIdle are closed.
+type WriterPool struct {
+	sync.Mutex
+	m       *Nitro
+	idle    []*Writer
+	maxIdle int
+	closed  bool
+}
+
+// NewWriterPool creates a writer pool which keeps up to maxIdle idle writers
+func (m *Nitro) NewWriterPool(maxIdle int) *WriterPool {
+	return &WriterPool{m: m, maxIdle: maxIdle}
+}
+
+// Get returns an idle writer or creates a new writer
+func (p *WriterPool) Get() *Writer {
+	p.Lock()
+	defer p.Unlock()
+
+	if n := len(p.idle); n > 0 {
+		w := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		return w
+	}
+
+	return p.m.NewWriter()
+}
+
+// Put returns a writer to the pool
+func (p *WriterPool) Put(w *Writer) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.closed || len(p.idle) >= p.maxIdle {
+		w.Close()
+		return
+	}
+
+	p.idle = append(p.idle, w)
+}
+
+// Close closes the idle writers. The writers returned to the pool after
+// Close are closed.
+func (p *WriterPool) Close() {
+	p.Lock()
+	defer p.Unlock()
+
+	for _, w := range p.idle {
+		w.Close()
+	}
+
+	p.idle = nil
+	p.closed = true
+}